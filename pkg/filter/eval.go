@@ -0,0 +1,187 @@
+package filter
+
+import (
+	"strings"
+
+	"github.com/NeedleInAJayStack/haystack"
+)
+
+// Resolver returns the record with the given id, and false if it cannot be found.
+// It is used to dereference the Refs in a path, like `equipRef->siteRef`.
+type Resolver func(id haystack.Ref) (haystack.Dict, bool)
+
+// Matches returns true if the record matches the filter. The resolver is used to dereference Ref paths.
+// It may be nil, in which case paths with more than one name never match.
+func Matches(node Node, record haystack.Dict, resolver Resolver) bool {
+	switch node := node.(type) {
+	case Has:
+		return !isNull(resolvePath(node.Path, record, resolver))
+	case Missing:
+		return isNull(resolvePath(node.Path, record, resolver))
+	case Cmp:
+		val := resolvePath(node.Path, record, resolver)
+		if isNull(val) {
+			return false
+		}
+		return compare(val, node.Op, node.Val)
+	case And:
+		return Matches(node.Left, record, resolver) && Matches(node.Right, record, resolver)
+	case Or:
+		return Matches(node.Left, record, resolver) || Matches(node.Right, record, resolver)
+	default:
+		return false
+	}
+}
+
+// resolvePath returns the value at the path, or nil if it cannot be resolved
+func resolvePath(path Path, record haystack.Dict, resolver Resolver) haystack.Val {
+	val := record.Get(path[0])
+	for _, name := range path[1:] {
+		ref, isRef := val.(haystack.Ref)
+		if !isRef || resolver == nil {
+			return nil
+		}
+		next, ok := resolver(ref)
+		if !ok {
+			return nil
+		}
+		val = next.Get(name)
+	}
+	return val
+}
+
+func isNull(val haystack.Val) bool {
+	if val == nil {
+		return true
+	}
+	_, isNull := val.(haystack.Null)
+	return isNull
+}
+
+// compare compares the record value to the filter value. As in the Haystack filter spec, values of different
+// kinds never match, so a DateTime is never equal, less, or greater than a Date. `!=` is the negation of `==`,
+// so it matches any value of a different kind, like a Number compared to a Str.
+func compare(val haystack.Val, op CmpOp, filterVal haystack.Val) bool {
+	switch op {
+	case Eq:
+		return equal(val, filterVal)
+	case Ne:
+		return !equal(val, filterVal)
+	}
+	order, comparable := compareVals(val, filterVal)
+	if !comparable {
+		return false
+	}
+	switch op {
+	case Lt:
+		return order < 0
+	case Le:
+		return order <= 0
+	case Gt:
+		return order > 0
+	case Ge:
+		return order >= 0
+	default:
+		return false
+	}
+}
+
+// equal returns true if the values are the same kind and equal. Numbers are only equal if their units are too.
+func equal(a haystack.Val, b haystack.Val) bool {
+	if a, ok := a.(haystack.Number); ok {
+		b, ok := b.(haystack.Number)
+		return ok && a.Unit() == b.Unit() && a.Float() == b.Float()
+	}
+	order, comparable := compareVals(a, b)
+	return comparable && order == 0
+}
+
+// compareVals returns -1, 0, or 1 if a is less than, equal to, or greater than b, and false if they
+// can't be compared. Numbers with different units can't be compared, unless one of them is unitless.
+func compareVals(a haystack.Val, b haystack.Val) (int, bool) {
+	switch a := a.(type) {
+	case haystack.Number:
+		b, ok := b.(haystack.Number)
+		if !ok || (a.Unit() != b.Unit() && a.Unit() != "" && b.Unit() != "") {
+			return 0, false
+		}
+		return compareOrdered(a.Float(), b.Float()), true
+	case haystack.Str:
+		b, ok := b.(haystack.Str)
+		if !ok {
+			return 0, false
+		}
+		return strings.Compare(a.String(), b.String()), true
+	case haystack.Ref:
+		b, ok := b.(haystack.Ref)
+		if !ok {
+			return 0, false
+		}
+		return strings.Compare(a.Id(), b.Id()), true
+	case haystack.Bool:
+		b, ok := b.(haystack.Bool)
+		if !ok {
+			return 0, false
+		}
+		return compareOrdered(boolToInt(a.ToBool()), boolToInt(b.ToBool())), true
+	case haystack.Date:
+		b, ok := b.(haystack.Date)
+		if !ok {
+			return 0, false
+		}
+		return compareInts(
+			[]int{a.Year(), a.Month(), a.Day()},
+			[]int{b.Year(), b.Month(), b.Day()},
+		), true
+	case haystack.Time:
+		b, ok := b.(haystack.Time)
+		if !ok {
+			return 0, false
+		}
+		return compareInts(
+			[]int{a.Hour(), a.Minute(), a.Second(), a.Millisecond()},
+			[]int{b.Hour(), b.Minute(), b.Second(), b.Millisecond()},
+		), true
+	case haystack.Uri:
+		b, ok := b.(haystack.Uri)
+		if !ok {
+			return 0, false
+		}
+		return strings.Compare(a.String(), b.String()), true
+	case haystack.Symbol:
+		b, ok := b.(haystack.Symbol)
+		if !ok {
+			return 0, false
+		}
+		return strings.Compare(a.ToZinc(), b.ToZinc()), true
+	default:
+		return 0, false
+	}
+}
+
+func compareOrdered[T int | float64](a T, b T) int {
+	if a < b {
+		return -1
+	}
+	if a > b {
+		return 1
+	}
+	return 0
+}
+
+// compareInts compares the slices lexicographically. They must have the same length.
+func compareInts(a []int, b []int) int {
+	for i := range a {
+		if order := compareOrdered(a[i], b[i]); order != 0 {
+			return order
+		}
+	}
+	return 0
+}
+
+func boolToInt(value bool) int {
+	if value {
+		return 1
+	}
+	return 0
+}
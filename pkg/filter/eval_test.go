@@ -0,0 +1,99 @@
+package filter
+
+import (
+	"testing"
+	"time"
+
+	"github.com/NeedleInAJayStack/haystack"
+)
+
+func TestMatches(t *testing.T) {
+	records := map[string]haystack.Dict{
+		"site-1": haystack.NewDict(map[string]haystack.Val{
+			"id":   haystack.NewRef("site-1", ""),
+			"site": haystack.NewMarker(),
+			"dis":  haystack.NewStr("Site 1"),
+		}),
+		"equip-1": haystack.NewDict(map[string]haystack.Val{
+			"id":      haystack.NewRef("equip-1", ""),
+			"equip":   haystack.NewMarker(),
+			"siteRef": haystack.NewRef("site-1", ""),
+		}),
+	}
+	resolver := func(id haystack.Ref) (haystack.Dict, bool) {
+		record, ok := records[id.Id()]
+		return record, ok
+	}
+
+	point := haystack.NewDict(map[string]haystack.Val{
+		"id":       haystack.NewRef("point-1", ""),
+		"point":    haystack.NewMarker(),
+		"his":      haystack.NewMarker(),
+		"equipRef": haystack.NewRef("equip-1", ""),
+		"curVal":   haystack.NewNumber(72.5, "°F"),
+		"enabled":  haystack.NewBool(true),
+		"kind":     haystack.NewStr("Number"),
+		"mod":      haystack.NewDateTimeFromGo(time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)),
+		"occStart": haystack.NewTime(8, 30, 0, 0),
+	})
+
+	tests := map[string]bool{
+		"point":                                true,
+		"site":                                 false,
+		"not site":                             true,
+		"not point":                            false,
+		"point and his":                        true,
+		"point and site":                       false,
+		"site or his":                          true,
+		"curVal > 70°F":                        true,
+		"curVal > 70":                          true,
+		"curVal <= 72.5°F":                     true,
+		"curVal < 72.5°F":                      false,
+		"curVal == 72.5°F":                     true,
+		"curVal != 72.5°F":                     false,
+		"curVal == 72.5°C":                     false,
+		"curVal != 72.5°C":                     true,
+		"curVal == 72.5":                       false, // Equal Numbers have the same unit
+		"curVal != 72.5":                       true,
+		"curVal != \"off\"":                    true, // Values of different kinds are never equal
+		"curVal == \"72.5\"":                   false,
+		"missingTag != 5":                      false,
+		"enabled == true":                      true,
+		"kind == \"Number\"":                   true,
+		"kind != \"Bool\"":                     true,
+		"equipRef == @equip-1":                 true,
+		"equipRef->siteRef == @site-1":         true,
+		"equipRef->siteRef->dis == \"Site 1\"": true,
+		"equipRef->siteRef->site":              true,
+		"equipRef->siteRef->equip":             false,
+		"equipRef->missing->dis":               false,
+		"mod >= 2024-05-01":                    false, // DateTimes and Dates are different kinds
+		"mod < 2024-05-01":                     false,
+		"mod != 2024-05-01":                    true,
+		"occStart < 09:00":                     true,
+	}
+
+	for input, expected := range tests {
+		node, err := Parse(input)
+		if err != nil {
+			t.Errorf("Parse(%q): %v", input, err)
+			continue
+		}
+		if actual := Matches(node, point, resolver); actual != expected {
+			t.Errorf("Matches(%q): expected %v, got %v", input, expected, actual)
+		}
+	}
+}
+
+func TestMatches_NilResolver(t *testing.T) {
+	record := haystack.NewDict(map[string]haystack.Val{
+		"equipRef": haystack.NewRef("equip-1", ""),
+	})
+	node, err := Parse("equipRef->equip")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if Matches(node, record, nil) {
+		t.Error("Ref paths must not match without a resolver")
+	}
+}
@@ -0,0 +1,118 @@
+// Package filter parses Haystack filters into an abstract syntax tree.
+// See https://project-haystack.org/doc/docHaystack/Filters
+package filter
+
+import (
+	"strings"
+
+	"github.com/NeedleInAJayStack/haystack"
+)
+
+// Node is a node in a parsed Haystack filter. Its String method returns the node encoded as a filter.
+type Node interface {
+	String() string
+	node()
+}
+
+// Path is a tag name, or a chain of tag names that dereference Refs, like `equipRef->siteRef->dis`
+type Path []string
+
+func (path Path) String() string {
+	return strings.Join(path, "->")
+}
+
+// Has matches records that have the tag at the path
+type Has struct {
+	Path Path
+}
+
+// Missing matches records that don't have the tag at the path
+type Missing struct {
+	Path Path
+}
+
+// Cmp matches records whose tag at the path compares to the value using the operator
+type Cmp struct {
+	Path Path
+	Op   CmpOp
+	Val  haystack.Val
+}
+
+// CmpOp is a comparison operator
+type CmpOp string
+
+const (
+	Eq CmpOp = "=="
+	Ne CmpOp = "!="
+	Lt CmpOp = "<"
+	Le CmpOp = "<="
+	Gt CmpOp = ">"
+	Ge CmpOp = ">="
+)
+
+// And matches records that match both the left and right filters
+type And struct {
+	Left  Node
+	Right Node
+}
+
+// Or matches records that match either the left or right filters
+type Or struct {
+	Left  Node
+	Right Node
+}
+
+func (Has) node()     {}
+func (Missing) node() {}
+func (Cmp) node()     {}
+func (And) node()     {}
+func (Or) node()      {}
+
+func (has Has) String() string {
+	return has.Path.String()
+}
+
+func (missing Missing) String() string {
+	return "not " + missing.Path.String()
+}
+
+func (cmp Cmp) String() string {
+	return cmp.Path.String() + " " + string(cmp.Op) + " " + valToFilter(cmp.Val)
+}
+
+func (and And) String() string {
+	return parenthesizeOr(and.Left) + " and " + parenthesizeOr(and.Right)
+}
+
+func (or Or) String() string {
+	return or.Left.String() + " or " + or.Right.String()
+}
+
+// parenthesizeOr wraps `or` nodes in parentheses, since `and` binds more tightly
+func parenthesizeOr(node Node) string {
+	if _, isOr := node.(Or); isOr {
+		return "(" + node.String() + ")"
+	}
+	return node.String()
+}
+
+// valToFilter encodes a value as a filter literal
+func valToFilter(val haystack.Val) string {
+	switch val := val.(type) {
+	case haystack.Bool:
+		if val.ToBool() {
+			return "true"
+		}
+		return "false"
+	case haystack.Ref:
+		return "@" + val.Id()
+	default:
+		return val.ToZinc()
+	}
+}
+
+// AndWith returns a filter that matches the records matched by both the filter and the clause.
+// Unlike string concatenation, this is correct when the filter contains a top-level `or`.
+func AndWith(filter Node, clause Node) Node {
+	return And{Left: filter, Right: clause}
+}
@@ -0,0 +1,82 @@
+package filter
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestParse(t *testing.T) {
+	// Each filter is parsed and re-encoded
+	tests := map[string]string{
+		"site":                                  "site",
+		"not site":                              "not site",
+		"equip and ahu":                         "equip and ahu",
+		"ahu or rtu":                            "ahu or rtu",
+		"equip and (ahu or rtu)":                "equip and (ahu or rtu)",
+		"(equip and ahu) or rtu":                "equip and ahu or rtu",
+		"equipRef->siteRef->dis == \"Site 1\"":  "equipRef->siteRef->dis == \"Site 1\"",
+		"siteRef==@abc-123":                     "siteRef == @abc-123",
+		"curVal >= 72.5°F":                      "curVal >= 72.5°F",
+		"curVal < -5":                           "curVal < -5",
+		"occupied == true and enabled != false": "occupied == true and enabled != false",
+		"mod > 2024-01-31":                      "mod > 2024-01-31",
+		"occStart <= 08:30:00":                  "occStart <= 08:30:00",
+		"uri == `http://host/a`":                "uri == `http://host/a`",
+		"def == ^elec-meter":                    "def == ^elec-meter",
+		"dis == \"Quote \\\" and \\\\ slash\"":  "dis == \"Quote \\\" and \\\\ slash\"",
+		"android":                               "android",
+		"notes and order":                       "notes and order",
+	}
+
+	for input, expected := range tests {
+		node, err := Parse(input)
+		if err != nil {
+			t.Errorf("Parse(%q): %v", input, err)
+			continue
+		}
+		if node.String() != expected {
+			t.Errorf("Parse(%q): expected %q, got %q", input, expected, node.String())
+		}
+	}
+}
+
+func TestParse_Errors(t *testing.T) {
+	// The expected position of the error in each filter
+	tests := map[string]int{
+		"":                  0,
+		"site and":          8,
+		"site and or equip": 9,
+		"(site":             5,
+		"site)":             4,
+		"curVal ==":         9,
+		"curVal == abc":     10,
+		"dis == \"abc":      7,
+		"mod > 2024-13-01":  6,
+		"site equip":        5,
+		"siteRef == @":      12,
+	}
+
+	for input, expectedPos := range tests {
+		_, err := Parse(input)
+		var parseErr ParseError
+		if !errors.As(err, &parseErr) {
+			t.Errorf("Parse(%q): expected ParseError, got %v", input, err)
+			continue
+		}
+		if parseErr.Pos != expectedPos {
+			t.Errorf("Parse(%q): expected error at %d, got %v", input, expectedPos, parseErr)
+		}
+	}
+}
+
+func TestAndWith(t *testing.T) {
+	node, err := Parse("ahu or rtu")
+	if err != nil {
+		t.Fatal(err)
+	}
+	actual := AndWith(node, Has{Path: Path{"his"}}).String()
+	expected := "(ahu or rtu) and his"
+	if actual != expected {
+		t.Errorf("expected %q, got %q", expected, actual)
+	}
+}
@@ -0,0 +1,417 @@
+package filter
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"github.com/NeedleInAJayStack/haystack"
+)
+
+// ParseError is returned when a filter cannot be parsed. Pos is the byte offset in the filter where the error occurred.
+type ParseError struct {
+	Pos int
+	Msg string
+}
+
+func (err ParseError) Error() string {
+	return fmt.Sprintf("invalid filter at position %d: %s", err.Pos, err.Msg)
+}
+
+// Parse parses a Haystack filter. If the filter is invalid, a ParseError is returned.
+func Parse(filter string) (Node, error) {
+	parser := parser{input: filter}
+	parser.skipSpace()
+	if parser.atEnd() {
+		return nil, parser.errorf("empty filter")
+	}
+	node, err := parser.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	parser.skipSpace()
+	if !parser.atEnd() {
+		return nil, parser.errorf("unexpected %q", parser.input[parser.pos:parser.pos+1])
+	}
+	return node, nil
+}
+
+type parser struct {
+	input string
+	pos   int
+}
+
+func (parser *parser) errorf(format string, args ...any) ParseError {
+	return ParseError{Pos: parser.pos, Msg: fmt.Sprintf(format, args...)}
+}
+
+func (parser *parser) atEnd() bool {
+	return parser.pos >= len(parser.input)
+}
+
+func (parser *parser) peek() byte {
+	if parser.atEnd() {
+		return 0
+	}
+	return parser.input[parser.pos]
+}
+
+func (parser *parser) skipSpace() {
+	for !parser.atEnd() && unicode.IsSpace(rune(parser.peek())) {
+		parser.pos++
+	}
+}
+
+// keyword consumes the keyword if it is next in the input and is not the prefix of a longer name
+func (parser *parser) keyword(keyword string) bool {
+	parser.skipSpace()
+	end := parser.pos + len(keyword)
+	if end > len(parser.input) || parser.input[parser.pos:end] != keyword {
+		return false
+	}
+	if end < len(parser.input) && isNameChar(parser.input[end]) {
+		return false
+	}
+	parser.pos = end
+	return true
+}
+
+// <condOr> := <condAnd> ("or" <condAnd>)*
+func (parser *parser) parseOr() (Node, error) {
+	node, err := parser.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	for parser.keyword("or") {
+		right, err := parser.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		node = Or{Left: node, Right: right}
+	}
+	return node, nil
+}
+
+// <condAnd> := <term> ("and" <term>)*
+func (parser *parser) parseAnd() (Node, error) {
+	node, err := parser.parseTerm()
+	if err != nil {
+		return nil, err
+	}
+	for parser.keyword("and") {
+		right, err := parser.parseTerm()
+		if err != nil {
+			return nil, err
+		}
+		node = And{Left: node, Right: right}
+	}
+	return node, nil
+}
+
+// <term> := <parens> | <has> | <missing> | <cmp>
+func (parser *parser) parseTerm() (Node, error) {
+	parser.skipSpace()
+	if parser.atEnd() {
+		return nil, parser.errorf("unexpected end of filter")
+	}
+
+	if parser.peek() == '(' {
+		parser.pos++
+		node, err := parser.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		parser.skipSpace()
+		if parser.peek() != ')' {
+			return nil, parser.errorf("expected ')'")
+		}
+		parser.pos++
+		return node, nil
+	}
+
+	if parser.keyword("not") {
+		path, err := parser.parsePath()
+		if err != nil {
+			return nil, err
+		}
+		return Missing{Path: path}, nil
+	}
+
+	path, err := parser.parsePath()
+	if err != nil {
+		return nil, err
+	}
+	op, ok := parser.parseCmpOp()
+	if !ok {
+		return Has{Path: path}, nil
+	}
+	val, err := parser.parseVal()
+	if err != nil {
+		return nil, err
+	}
+	return Cmp{Path: path, Op: op, Val: val}, nil
+}
+
+// <path> := <name> ("->" <name>)*
+func (parser *parser) parsePath() (Path, error) {
+	path := Path{}
+	for {
+		name, err := parser.parseName()
+		if err != nil {
+			return nil, err
+		}
+		path = append(path, name)
+		if !strings.HasPrefix(parser.input[parser.pos:], "->") {
+			return path, nil
+		}
+		parser.pos += 2
+	}
+}
+
+func (parser *parser) parseName() (string, error) {
+	parser.skipSpace()
+	start := parser.pos
+	if parser.atEnd() || !isNameStart(parser.peek()) {
+		if parser.atEnd() {
+			return "", parser.errorf("expected tag name, found end of filter")
+		}
+		return "", parser.errorf("expected tag name, found %q", parser.input[parser.pos:parser.pos+1])
+	}
+	for !parser.atEnd() && isNameChar(parser.peek()) {
+		parser.pos++
+	}
+	name := parser.input[start:parser.pos]
+	switch name {
+	case "and", "or", "not":
+		parser.pos = start
+		return "", parser.errorf("expected tag name, found keyword %q", name)
+	}
+	return name, nil
+}
+
+func (parser *parser) parseCmpOp() (CmpOp, bool) {
+	parser.skipSpace()
+	// Check two-character operators first
+	for _, op := range []CmpOp{Eq, Ne, Le, Ge, Lt, Gt} {
+		if strings.HasPrefix(parser.input[parser.pos:], string(op)) {
+			parser.pos += len(op)
+			return op, true
+		}
+	}
+	return "", false
+}
+
+// <val> := <bool> | <ref> | <str> | <uri> | <number> | <date> | <time> | <symbol>
+func (parser *parser) parseVal() (haystack.Val, error) {
+	parser.skipSpace()
+	if parser.atEnd() {
+		return nil, parser.errorf("expected value, found end of filter")
+	}
+	start := parser.pos
+
+	switch char := parser.peek(); {
+	case char == '@':
+		parser.pos++
+		id := parser.consume(isRefChar)
+		if id == "" {
+			return nil, parser.errorf("expected Ref id")
+		}
+		return haystack.NewRef(id, ""), nil
+	case char == '^':
+		parser.pos++
+		symbol := parser.consume(isRefChar)
+		if symbol == "" {
+			return nil, parser.errorf("expected Symbol name")
+		}
+		return haystack.NewSymbol(symbol), nil
+	case char == '"':
+		return parser.parseStr()
+	case char == '`':
+		parser.pos++
+		end := strings.IndexByte(parser.input[parser.pos:], '`')
+		if end < 0 {
+			parser.pos = start
+			return nil, parser.errorf("unterminated Uri")
+		}
+		uri := parser.input[parser.pos : parser.pos+end]
+		parser.pos += end + 1
+		return haystack.NewUri(uri), nil
+	case char == '-' || isDigit(char):
+		return parser.parseNumberDateOrTime()
+	case isNameStart(char):
+		word := parser.consume(isNameChar)
+		switch word {
+		case "true":
+			return haystack.NewBool(true), nil
+		case "false":
+			return haystack.NewBool(false), nil
+		}
+		parser.pos = start
+		return nil, parser.errorf("expected value, found %q", word)
+	default:
+		return nil, parser.errorf("expected value, found %q", string(char))
+	}
+}
+
+func (parser *parser) parseStr() (haystack.Val, error) {
+	start := parser.pos
+	parser.pos++ // opening quote
+	var builder strings.Builder
+	for {
+		if parser.atEnd() {
+			parser.pos = start
+			return nil, parser.errorf("unterminated Str")
+		}
+		char := parser.peek()
+		parser.pos++
+		switch char {
+		case '"':
+			return haystack.NewStr(builder.String()), nil
+		case '\\':
+			if parser.atEnd() {
+				parser.pos = start
+				return nil, parser.errorf("unterminated Str")
+			}
+			escape := parser.peek()
+			parser.pos++
+			switch escape {
+			case 'b':
+				builder.WriteByte('\b')
+			case 'f':
+				builder.WriteByte('\f')
+			case 'n':
+				builder.WriteByte('\n')
+			case 'r':
+				builder.WriteByte('\r')
+			case 't':
+				builder.WriteByte('\t')
+			case '"', '\\', '$', '`':
+				builder.WriteByte(escape)
+			case 'u':
+				if parser.pos+4 > len(parser.input) {
+					return nil, parser.errorf("invalid unicode escape")
+				}
+				code, err := strconv.ParseUint(parser.input[parser.pos:parser.pos+4], 16, 32)
+				if err != nil {
+					return nil, parser.errorf("invalid unicode escape")
+				}
+				builder.WriteRune(rune(code))
+				parser.pos += 4
+			default:
+				parser.pos--
+				return nil, parser.errorf("invalid escape '\\%c'", escape)
+			}
+		default:
+			builder.WriteByte(char)
+		}
+	}
+}
+
+func (parser *parser) parseNumberDateOrTime() (haystack.Val, error) {
+	start := parser.pos
+	literal := parser.consume(func(char byte) bool {
+		return isDigit(char) || char == '-' || char == ':' || char == '.'
+	})
+
+	// Date: YYYY-MM-DD
+	if len(literal) == 10 && literal[4] == '-' && literal[7] == '-' {
+		year, yearErr := strconv.Atoi(literal[0:4])
+		month, monthErr := strconv.Atoi(literal[5:7])
+		day, dayErr := strconv.Atoi(literal[8:10])
+		if yearErr != nil || monthErr != nil || dayErr != nil || month < 1 || month > 12 || day < 1 || day > 31 {
+			parser.pos = start
+			return nil, parser.errorf("invalid Date %q", literal)
+		}
+		return haystack.NewDate(year, month, day), nil
+	}
+
+	// Time: hh:mm, hh:mm:ss, or hh:mm:ss.FFF
+	if len(literal) >= 5 && literal[2] == ':' {
+		return parser.parseTime(start, literal)
+	}
+
+	// Number with an optional exponent and unit
+	if strings.HasPrefix(parser.input[parser.pos:], "e") || strings.HasPrefix(parser.input[parser.pos:], "E") {
+		exponentStart := parser.pos
+		parser.pos++
+		if parser.peek() == '+' || parser.peek() == '-' {
+			parser.pos++
+		}
+		if isDigit(parser.peek()) {
+			parser.consume(isDigit)
+			literal = parser.input[start:parser.pos]
+		} else {
+			parser.pos = exponentStart
+		}
+	}
+	value, err := strconv.ParseFloat(literal, 64)
+	if err != nil {
+		parser.pos = start
+		return nil, parser.errorf("invalid Number %q", literal)
+	}
+	unit := parser.consume(isUnitChar)
+	return haystack.NewNumber(value, unit), nil
+}
+
+func (parser *parser) parseTime(start int, literal string) (haystack.Val, error) {
+	invalid := func() (haystack.Val, error) {
+		parser.pos = start
+		return nil, parser.errorf("invalid Time %q", literal)
+	}
+	parts := strings.Split(literal, ":")
+	if len(parts) < 2 || len(parts) > 3 {
+		return invalid()
+	}
+	hour, hourErr := strconv.Atoi(parts[0])
+	minute, minuteErr := strconv.Atoi(parts[1])
+	if hourErr != nil || minuteErr != nil || hour > 23 || minute > 59 {
+		return invalid()
+	}
+	second, millis := 0, 0
+	if len(parts) == 3 {
+		secondStr, fractionStr, hasFraction := strings.Cut(parts[2], ".")
+		var err error
+		second, err = strconv.Atoi(secondStr)
+		if err != nil || second > 59 {
+			return invalid()
+		}
+		if hasFraction {
+			fraction, err := strconv.ParseFloat("0."+fractionStr, 64)
+			if err != nil {
+				return invalid()
+			}
+			millis = int(fraction * 1000)
+		}
+	}
+	return haystack.NewTime(hour, minute, second, millis), nil
+}
+
+// consume advances past the characters that match the predicate and returns them
+func (parser *parser) consume(matches func(byte) bool) string {
+	start := parser.pos
+	for !parser.atEnd() && matches(parser.peek()) {
+		parser.pos++
+	}
+	return parser.input[start:parser.pos]
+}
+
+func isDigit(char byte) bool {
+	return char >= '0' && char <= '9'
+}
+
+func isNameStart(char byte) bool {
+	return char >= 'a' && char <= 'z' || char >= 'A' && char <= 'Z' || char == '_'
+}
+
+func isNameChar(char byte) bool {
+	return isNameStart(char) || isDigit(char)
+}
+
+func isRefChar(char byte) bool {
+	return isNameChar(char) || char == ':' || char == '-' || char == '.' || char == '~'
+}
+
+func isUnitChar(char byte) bool {
+	return char >= 'a' && char <= 'z' || char >= 'A' && char <= 'Z' || char == '%' || char == '_' || char == '/' || char == '$' || char >= 0x80
+}
@@ -0,0 +1,166 @@
+package plugin
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+
+	"github.com/NeedleInAJayStack/haystack"
+	"github.com/NeedleInAJayStack/haystack/io"
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/grafana/grafana-plugin-sdk-go/backend/log"
+)
+
+// The Grafana organization roles, in increasing order of privilege
+const (
+	roleViewer = "Viewer"
+	roleEditor = "Editor"
+	roleAdmin  = "Admin"
+)
+
+var actionRoles = []string{roleViewer, roleEditor, roleAdmin}
+
+// actionOptions controls access to the `actions` resource, which lists and invokes the actions defined on records
+type actionOptions struct {
+	enabled bool
+	role    string // The minimum role that may use actions
+}
+
+func newActionOptions(options Options) actionOptions {
+	role := options.ActionsRole
+	if role == "" {
+		role = roleEditor
+	}
+	return actionOptions{enabled: options.EnableActions, role: role}
+}
+
+// allows returns an error if the user may not use actions
+func (options actionOptions) allows(user *backend.User) error {
+	if !options.enabled {
+		return fmt.Errorf("actions are not enabled for this data source")
+	}
+	if user == nil || user.Login == "" {
+		return fmt.Errorf("actions require a Grafana user")
+	}
+	required := slices.Index(actionRoles, options.role)
+	actual := slices.Index(actionRoles, user.Role)
+	if required < 0 || actual < required {
+		return fmt.Errorf("actions require the %s role", options.role)
+	}
+	return nil
+}
+
+// ActionRequest is the body of a POST `actions` resource request
+type ActionRequest struct {
+	Id     string            `json:"id"`     // The id of the record, with or without the `@` prefix
+	Action string            `json:"action"` // The name of the action
+	Args   map[string]string `json:"args"`   // The zinc-encoded arguments of the action, by name
+}
+
+// handleActions returns a handler for the `actions` resource. `GET /actions?id=<id>` responds with the record's
+// `actions` grid, and `POST /actions` invokes an action and responds with the result grid. See ActionRequest.
+// Both are only allowed if actions are enabled and the user has the required role, and each use is logged.
+func (datasource *Datasource) handleActions(options actionOptions, user *backend.User) http.HandlerFunc {
+	return func(writer http.ResponseWriter, request *http.Request) {
+		login := ""
+		if user != nil {
+			login = user.Login
+		}
+		err := options.allows(user)
+		if err != nil {
+			log.DefaultLogger.Warn("Action denied", "user", login, "error", err.Error())
+			http.Error(writer, err.Error(), http.StatusForbidden)
+			return
+		}
+
+		var grid haystack.Grid
+		switch request.Method {
+		case http.MethodGet:
+			id := request.URL.Query().Get("id")
+			log.DefaultLogger.Info("Listing actions", "user", login, "id", id)
+			grid, err = datasource.actions(request.Context(), id)
+			if err != nil {
+				log.DefaultLogger.Error(err.Error())
+				http.Error(writer, fmt.Sprintf("actions failure: %v", err.Error()), http.StatusBadRequest)
+				return
+			}
+		case http.MethodPost:
+			var actionRequest ActionRequest
+			err = json.NewDecoder(request.Body).Decode(&actionRequest)
+			if err != nil {
+				http.Error(writer, fmt.Sprintf("json unmarshal failure: %v", err.Error()), http.StatusBadRequest)
+				return
+			}
+			log.DefaultLogger.Info("Invoking action", "user", login, "id", actionRequest.Id, "action", actionRequest.Action, "args", actionRequest.Args)
+			grid, err = datasource.invokeAction(request.Context(), actionRequest)
+			if err != nil {
+				log.DefaultLogger.Error("Action failed", "user", login, "id", actionRequest.Id, "action", actionRequest.Action, "error", err.Error())
+				http.Error(writer, fmt.Sprintf("invokeAction failure: %v", err.Error()), http.StatusBadRequest)
+				return
+			}
+		default:
+			http.Error(writer, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		writer.Header().Set("Content-Type", "application/json")
+		err = json.NewEncoder(writer).Encode(grid)
+		if err != nil {
+			log.DefaultLogger.Error(err.Error())
+		}
+	}
+}
+
+// actions returns the `actions` grid of the record, or an empty grid if it has no actions
+func (datasource *Datasource) actions(ctx context.Context, id string) (haystack.Grid, error) {
+	id = strings.TrimPrefix(strings.TrimSpace(id), "@")
+	if id == "" {
+		return haystack.EmptyGrid(), fmt.Errorf("id is required")
+	}
+	records, err := datasource.readById(ctx, id, map[string]string{})
+	if err != nil {
+		return haystack.EmptyGrid(), err
+	}
+	if records.RowCount() == 0 {
+		return haystack.EmptyGrid(), fmt.Errorf("record not found: @%s", id)
+	}
+	actions, ok := records.RowAt(0).Get("actions").(haystack.Grid)
+	if !ok {
+		return haystack.EmptyGrid(), nil
+	}
+	return actions, nil
+}
+
+// invokeAction invokes the action on the record, with the decoded arguments
+func (datasource *Datasource) invokeAction(ctx context.Context, request ActionRequest) (haystack.Grid, error) {
+	id := strings.TrimPrefix(strings.TrimSpace(request.Id), "@")
+	if id == "" {
+		return haystack.EmptyGrid(), fmt.Errorf("id is required")
+	}
+	if request.Action == "" {
+		return haystack.EmptyGrid(), fmt.Errorf("action is required")
+	}
+	args := map[string]haystack.Val{}
+	for name, zinc := range request.Args {
+		zincReader := io.ZincReader{}
+		zincReader.InitString(zinc)
+		val, err := zincReader.ReadVal()
+		if err != nil {
+			return haystack.EmptyGrid(), fmt.Errorf("argument %s: %w", name, err)
+		}
+		args[name] = val
+	}
+
+	ref := haystack.NewRef(id, "")
+	// Actions may command equipment, so a failed request isn't retried in case the server carried it out
+	return datasource.withoutRetry(
+		ctx,
+		"invokeAction",
+		func() (haystack.Grid, error) {
+			return datasource.client.InvokeAction(ref, request.Action, args)
+		},
+	)
+}
@@ -0,0 +1,155 @@
+package plugin
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/NeedleInAJayStack/haystack"
+	haystackClient "github.com/NeedleInAJayStack/haystack/client"
+	"github.com/google/go-cmp/cmp"
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+)
+
+func TestCallResource_Actions(t *testing.T) {
+	actions := haystack.NewGridBuilder()
+	actions.AddCol("dis", map[string]haystack.Val{})
+	actions.AddCol("expr", map[string]haystack.Val{})
+	actions.AddRow([]haystack.Val{haystack.NewStr("Reset alarm"), haystack.NewStr("resetAlarm($self)")})
+	record := haystack.NewGridBuilder()
+	record.AddCol("id", map[string]haystack.Val{})
+	record.AddCol("actions", map[string]haystack.Val{})
+	record.AddRow([]haystack.Val{haystack.NewRef("equip-1", ""), actions.ToGrid()})
+
+	result := haystack.NewGridBuilder()
+	result.AddCol("result", map[string]haystack.Val{})
+	result.AddRow([]haystack.Val{haystack.NewStr("Alarm reset")})
+
+	client := &testHaystackClient{
+		readByIdsResponse: record.ToGrid(),
+		actionResponse:    result.ToGrid(),
+	}
+	ds := Datasource{client: client, actionOptions: actionOptions{enabled: true, role: roleEditor}}
+	editor := &backend.User{Login: "technician", Role: roleEditor}
+
+	resp := callActions(t, &ds, "GET", "actions?id=@equip-1", nil, editor)
+	if resp.Status != 200 {
+		t.Fatalf("Resource call had non-OK status '%v': %s", resp.Status, resp.Body)
+	}
+	if !strings.Contains(string(resp.Body), "Reset alarm") {
+		t.Errorf("Expected the record's actions, got %s", resp.Body)
+	}
+
+	body, err := json.Marshal(ActionRequest{Id: "@equip-1", Action: "resetAlarm", Args: map[string]string{"duration": "1hr", "note": "\"Reset\""}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp = callActions(t, &ds, "POST", "actions", body, editor)
+	if resp.Status != 200 {
+		t.Fatalf("Resource call had non-OK status '%v': %s", resp.Status, resp.Body)
+	}
+	if !strings.Contains(string(resp.Body), "Alarm reset") {
+		t.Errorf("Expected the result grid, got %s", resp.Body)
+	}
+	if len(client.actionCalls) != 1 {
+		t.Fatalf("Expected one action call, got %d", len(client.actionCalls))
+	}
+	call := client.actionCalls[0]
+	args := map[string]string{}
+	for name, val := range call.args {
+		args[name] = val.ToZinc()
+	}
+	if call.id != "equip-1" || call.action != "resetAlarm" || !cmp.Equal(args, map[string]string{"duration": "1hr", "note": "\"Reset\""}) {
+		t.Errorf("Unexpected action call: %s %s %v", call.id, call.action, args)
+	}
+}
+
+func TestCallResource_ActionsNotRetried(t *testing.T) {
+	body, err := json.Marshal(ActionRequest{Id: "equip-1", Action: "resetAlarm"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	editor := &backend.User{Login: "technician", Role: roleEditor}
+
+	// A failed action may still have been carried out, so it isn't retried after reconnecting
+	for _, code := range []int{403, 404, 500} {
+		client := &testHaystackClient{actionErr: haystackClient.HTTPError{Code: code, Msg: "Failed"}}
+		ds := Datasource{client: client, actionOptions: actionOptions{enabled: true, role: roleEditor}}
+		resp := callActions(t, &ds, "POST", "actions", body, editor)
+		if resp.Status != 400 {
+			t.Errorf("%d: expected status 400, got %v: %s", code, resp.Status, resp.Body)
+		}
+		if len(client.actionCalls) != 1 {
+			t.Errorf("%d: expected one action call, got %d", code, len(client.actionCalls))
+		}
+	}
+
+	// or on another endpoint
+	primary := &testHaystackClient{actionErr: haystackClient.HTTPError{Code: 503, Msg: "Service Unavailable"}}
+	secondary := &testHaystackClient{}
+	failover := newFailoverClient(
+		[]string{"http://primary/api/", "http://secondary/api/"},
+		[]HaystackClient{primary, secondary},
+	)
+	ds := Datasource{client: failover, actionOptions: actionOptions{enabled: true, role: roleEditor}}
+	resp := callActions(t, &ds, "POST", "actions", body, editor)
+	if resp.Status != 400 {
+		t.Errorf("Expected status 400, got %v: %s", resp.Status, resp.Body)
+	}
+	if len(primary.actionCalls) != 1 || len(secondary.actionCalls) != 0 {
+		t.Errorf("Expected one action call, got %d and %d", len(primary.actionCalls), len(secondary.actionCalls))
+	}
+}
+
+func TestCallResource_ActionsDenied(t *testing.T) {
+	body, err := json.Marshal(ActionRequest{Id: "equip-1", Action: "resetAlarm"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := map[string]struct {
+		options actionOptions
+		user    *backend.User
+	}{
+		"disabled":  {actionOptions{role: roleViewer}, &backend.User{Login: "admin", Role: roleAdmin}},
+		"no user":   {actionOptions{enabled: true, role: roleViewer}, nil},
+		"low role":  {actionOptions{enabled: true, role: roleEditor}, &backend.User{Login: "viewer", Role: roleViewer}},
+		"no role":   {actionOptions{enabled: true, role: roleViewer}, &backend.User{Login: "nobody", Role: "None"}},
+		"bad admin": {actionOptions{enabled: true, role: roleAdmin}, &backend.User{Login: "editor", Role: roleEditor}},
+	}
+	for name, test := range tests {
+		client := &testHaystackClient{}
+		ds := Datasource{client: client, actionOptions: test.options}
+		resp := callActions(t, &ds, "POST", "actions", body, test.user)
+		if resp.Status != 403 {
+			t.Errorf("%s: expected status 403, got %v: %s", name, resp.Status, resp.Body)
+		}
+		if len(client.actionCalls) != 0 {
+			t.Errorf("%s: expected no action calls, got %d", name, len(client.actionCalls))
+		}
+	}
+}
+
+// callActions sends an `actions` resource request as the user, and returns the response
+func callActions(t *testing.T, ds *Datasource, method string, url string, body []byte, user *backend.User) *backend.CallResourceResponse {
+	var resp *backend.CallResourceResponse
+	err := ds.CallResource(
+		context.Background(),
+		&backend.CallResourceRequest{
+			PluginContext: backend.PluginContext{User: user},
+			Method:        method,
+			Path:          "actions",
+			URL:           url,
+			Body:          body,
+		},
+		backend.CallResourceResponseSenderFunc(func(r *backend.CallResourceResponse) error {
+			resp = r
+			return nil
+		}),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp
+}
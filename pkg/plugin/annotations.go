@@ -0,0 +1,185 @@
+package plugin
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/NeedleInAJayStack/haystack"
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/grafana/grafana-plugin-sdk-go/data"
+)
+
+// Tags checked, in order, for the start, end, and duration of an annotation record
+var annotationStartTags = []string{"ts", "startTime", "start", "date"}
+var annotationEndTags = []string{"tsEnd", "endTime", "end", "clearTime"}
+var annotationDurTag = "dur"
+
+// Tags checked, in order, for the title and text of an annotation record
+var annotationTitleTags = []string{"dis", "ruleRef", "alarmName", "id"}
+var annotationTextTags = []string{"msg", "message", "targetRef", "help"}
+
+// annotations returns the records used to build annotations within the time range.
+// The source determines how `expr` is interpreted:
+//   - "read" (default): `expr` is a filter for the alarm records
+//   - "eval": `expr` is an Axon expression that returns the alarm records
+//   - "sparks": `expr` is a filter for the spark targets, which are passed to SkySpark's `ruleSparks`
+func (datasource *Datasource) annotations(ctx context.Context, source string, expr string, variables map[string]string) (haystack.Grid, error) {
+	switch source {
+	case "", "read":
+		return datasource.read(ctx, expr, variables)
+	case "eval":
+		return datasource.eval(ctx, expr, variables)
+	case "sparks":
+		sparks := fmt.Sprintf(
+			"ruleSparks(readAll(%s), (%s).date..(%s).date)",
+			expr,
+			variables["$__timeRange_start"],
+			variables["$__timeRange_end"],
+		)
+		return datasource.eval(ctx, sparks, variables)
+	default:
+		return haystack.EmptyGrid(), fmt.Errorf("invalid annotations source: %s", source)
+	}
+}
+
+// annotationFrameFromGrid converts the records in a haystack grid to a Grafana annotation frame,
+// with `time`, `timeEnd`, `title`, `text`, and `tags` fields. Records without a start time or
+// that don't overlap the time range are dropped. The frame is sorted by start time.
+func annotationFrameFromGrid(grid haystack.Grid, timeRange backend.TimeRange) *data.Frame {
+	type annotation struct {
+		time    time.Time
+		timeEnd *time.Time
+		title   string
+		text    string
+		tags    string
+	}
+
+	annotations := []annotation{}
+	for _, row := range grid.Rows() {
+		start, ok := annotationTime(row, annotationStartTags)
+		if !ok {
+			continue
+		}
+		var end *time.Time
+		if value, ok := annotationTime(row, annotationEndTags); ok {
+			end = &value
+		} else if dur, ok := row.Get(annotationDurTag).(haystack.Number); ok {
+			if duration, err := durationFromNumber(dur); err == nil && duration > 0 {
+				value := start.Add(duration)
+				end = &value
+			}
+		}
+
+		// Drop records outside of the time range
+		if start.After(timeRange.To) {
+			continue
+		}
+		if end == nil && start.Before(timeRange.From) {
+			continue
+		}
+		if end != nil && end.Before(timeRange.From) {
+			continue
+		}
+
+		annotations = append(annotations, annotation{
+			time:    start,
+			timeEnd: end,
+			title:   annotationString(row, annotationTitleTags),
+			text:    annotationString(row, annotationTextTags),
+			tags:    strings.Join(markerTags(grid, row), ","),
+		})
+	}
+
+	sort.SliceStable(annotations, func(i, j int) bool {
+		return annotations[i].time.Before(annotations[j].time)
+	})
+
+	times := []time.Time{}
+	timeEnds := []*time.Time{}
+	titles := []string{}
+	texts := []string{}
+	tags := []string{}
+	for _, annotation := range annotations {
+		times = append(times, annotation.time)
+		timeEnds = append(timeEnds, annotation.timeEnd)
+		titles = append(titles, annotation.title)
+		texts = append(texts, annotation.text)
+		tags = append(tags, annotation.tags)
+	}
+
+	frame := data.NewFrame("annotations",
+		data.NewField("time", nil, times),
+		data.NewField("timeEnd", nil, timeEnds),
+		data.NewField("title", nil, titles),
+		data.NewField("text", nil, texts),
+		data.NewField("tags", nil, tags),
+	)
+	return frame
+}
+
+// annotationTime returns the first DateTime or Date value found in the row for the given tags
+func annotationTime(row haystack.Row, tags []string) (time.Time, bool) {
+	for _, tag := range tags {
+		switch val := row.Get(tag).(type) {
+		case haystack.DateTime:
+			return val.ToGo(), true
+		case haystack.Date:
+			return time.Date(val.Year(), time.Month(val.Month()), val.Day(), 0, 0, 0, 0, time.UTC), true
+		}
+	}
+	return time.Time{}, false
+}
+
+// annotationString returns the display string of the first non-null value found in the row for the given tags
+func annotationString(row haystack.Row, tags []string) string {
+	for _, tag := range tags {
+		switch val := row.Get(tag).(type) {
+		case haystack.Null:
+			continue
+		case haystack.Str:
+			return val.String()
+		case haystack.Ref:
+			if val.Dis() != "" {
+				return val.Dis()
+			}
+			return val.ToZinc()
+		default:
+			return val.ToZinc()
+		}
+	}
+	return ""
+}
+
+// markerTags returns the names of the columns that have a Marker value in the row
+func markerTags(grid haystack.Grid, row haystack.Row) []string {
+	tags := []string{}
+	for _, col := range grid.Cols() {
+		if _, isMarker := row.Get(col.Name()).(haystack.Marker); isMarker {
+			tags = append(tags, col.Name())
+		}
+	}
+	return tags
+}
+
+// durationFromNumber converts a haystack Number with a time unit to a Go duration
+func durationFromNumber(number haystack.Number) (time.Duration, error) {
+	var unit time.Duration
+	switch number.Unit() {
+	case "ms":
+		unit = time.Millisecond
+	case "s", "sec":
+		unit = time.Second
+	case "min":
+		unit = time.Minute
+	case "h", "hr":
+		unit = time.Hour
+	case "day":
+		unit = 24 * time.Hour
+	default:
+		return 0, fmt.Errorf("unsupported duration unit: %s", number.Unit())
+	}
+	return time.Duration(number.Float() * float64(unit)), nil
+}
@@ -0,0 +1,241 @@
+package plugin
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/NeedleInAJayStack/haystack/client"
+	"github.com/grafana/grafana-plugin-sdk-go/backend/httpclient"
+)
+
+// Authentication modes supported by the datasource
+const (
+	authModeBasic  = "basic"  // Haystack SCRAM or Basic authentication using the username and password. This is the default.
+	authModeBearer = "bearer" // An `Authorization: Bearer` token, either static or fetched from a token endpoint
+	authModeApiKey = "apiKey" // A static API key in a custom header
+)
+
+const defaultApiKeyHeader = "X-API-Key"
+
+// Tokens are re-fetched this long before they expire
+const tokenExpiryLeeway = 30 * time.Second
+
+// headerAuth authenticates requests by adding headers to them, instead of using the Haystack `Open` handshake
+type headerAuth struct {
+	mode         string
+	bearerToken  string
+	apiKeyHeader string
+	apiKey       string
+	tokens       *tokenSource // nil if a static bearer token is used
+}
+
+// newHeaderAuth creates a headerAuth from the datasource options and secure settings. The http client is used to
+// fetch tokens from the token endpoint, if one is configured.
+func newHeaderAuth(options Options, secureSettings map[string]string, httpClient *http.Client) (*headerAuth, error) {
+	auth := headerAuth{mode: options.AuthMode}
+	switch options.AuthMode {
+	case authModeBearer:
+		if options.TokenUrl != "" {
+			auth.tokens = &tokenSource{
+				httpClient:   httpClient,
+				url:          options.TokenUrl,
+				clientId:     options.ClientId,
+				clientSecret: secureSettings["clientSecret"],
+				scope:        options.TokenScope,
+			}
+		} else {
+			auth.bearerToken = secureSettings["bearerToken"]
+			if auth.bearerToken == "" {
+				return nil, fmt.Errorf("bearer token or token URL is required")
+			}
+		}
+	case authModeApiKey:
+		auth.apiKeyHeader = options.ApiKeyHeader
+		if auth.apiKeyHeader == "" {
+			auth.apiKeyHeader = defaultApiKeyHeader
+		}
+		auth.apiKey = secureSettings["apiKey"]
+		if auth.apiKey == "" {
+			return nil, fmt.Errorf("API key is required")
+		}
+	default:
+		return nil, fmt.Errorf("unsupported auth mode: %s", options.AuthMode)
+	}
+	return &auth, nil
+}
+
+// middleware returns an http client middleware that adds the auth headers to every request
+func (auth *headerAuth) middleware() httpclient.Middleware {
+	return httpclient.NamedMiddlewareFunc("haystack-header-auth", func(opts httpclient.Options, next http.RoundTripper) http.RoundTripper {
+		return httpclient.RoundTripperFunc(func(req *http.Request) (*http.Response, error) {
+			// RoundTrippers must not modify the request, so modify a copy
+			req = req.Clone(req.Context())
+			switch auth.mode {
+			case authModeBearer:
+				token := auth.bearerToken
+				if auth.tokens != nil {
+					var err error
+					token, err = auth.tokens.token(req.Context())
+					if err != nil {
+						return nil, fmt.Errorf("fetch token: %w", err)
+					}
+				}
+				req.Header.Set("Authorization", "Bearer "+token)
+			case authModeApiKey:
+				// Drop the Haystack auth header, which is empty since the handshake was skipped
+				req.Header.Del("Authorization")
+				req.Header.Set(auth.apiKeyHeader, auth.apiKey)
+			}
+			return next.RoundTrip(req)
+		})
+	})
+}
+
+// reset discards any fetched token, so that a new one is fetched on the next request
+func (auth *headerAuth) reset() {
+	if auth.tokens != nil {
+		auth.tokens.reset()
+	}
+}
+
+// headerAuthClient is a haystack client that is authenticated using headerAuth. It skips the `Open` handshake,
+// and instead re-fetches the token when opened.
+type headerAuthClient struct {
+	*client.Client
+	auth *headerAuth // nil if the headers are added by another middleware, like a forwarded identity
+}
+
+// Open resets the auth token instead of performing the Haystack handshake
+func (authClient headerAuthClient) Open() error {
+	if authClient.auth != nil {
+		authClient.auth.reset()
+	}
+	return nil
+}
+
+// Close is a no-op, since no Haystack session was opened
+func (authClient headerAuthClient) Close() error {
+	return nil
+}
+
+// tokenSource fetches short-lived tokens from an OAuth 2.0 token endpoint using the client credentials grant,
+// and caches them until they expire. Concurrent requests share a single fetch, and the mutex isn't held while
+// fetching, so a slow token endpoint only delays the requests that need a new token.
+type tokenSource struct {
+	httpClient   *http.Client
+	url          string
+	clientId     string
+	clientSecret string
+	scope        string
+
+	mutex    sync.Mutex
+	value    string
+	expiry   time.Time   // Zero if the token doesn't expire
+	fetching *tokenFetch // The fetch in progress, or nil
+}
+
+// tokenFetch is a request to the token endpoint, shared by the requests waiting for it
+type tokenFetch struct {
+	done  chan struct{} // Closed once the fetch completes
+	value string
+	err   error
+}
+
+// token returns the cached token, fetching a new one if it is missing or about to expire. The fetch is cancelled
+// with the context. If another request's fetch is cancelled while this one waits for it, the fetch is retried.
+func (source *tokenSource) token(ctx context.Context) (string, error) {
+	for {
+		source.mutex.Lock()
+		if source.value != "" && (source.expiry.IsZero() || time.Now().Add(tokenExpiryLeeway).Before(source.expiry)) {
+			value := source.value
+			source.mutex.Unlock()
+			return value, nil
+		}
+		fetch := source.fetching
+		if fetch == nil {
+			fetch = &tokenFetch{done: make(chan struct{})}
+			source.fetching = fetch
+			source.mutex.Unlock()
+
+			value, expiry, err := source.fetch(ctx)
+			source.mutex.Lock()
+			source.fetching = nil
+			if err == nil {
+				source.value = value
+				source.expiry = expiry
+			}
+			source.mutex.Unlock()
+			fetch.value, fetch.err = value, err
+			close(fetch.done)
+			return value, err
+		}
+		source.mutex.Unlock()
+
+		select {
+		case <-fetch.done:
+			cancelled := errors.Is(fetch.err, context.Canceled) || errors.Is(fetch.err, context.DeadlineExceeded)
+			if cancelled && ctx.Err() == nil {
+				continue
+			}
+			return fetch.value, fetch.err
+		case <-ctx.Done():
+			return "", ctx.Err()
+		}
+	}
+}
+
+// fetch requests a new token from the token endpoint, returning it with its expiry
+func (source *tokenSource) fetch(ctx context.Context) (string, time.Time, error) {
+	form := url.Values{}
+	form.Set("grant_type", "client_credentials")
+	form.Set("client_id", source.clientId)
+	form.Set("client_secret", source.clientSecret)
+	if source.scope != "" {
+		form.Set("scope", source.scope)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, source.url, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	resp, err := source.httpClient.Do(req)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", time.Time{}, fmt.Errorf("token endpoint returned status %d", resp.StatusCode)
+	}
+
+	var body struct {
+		AccessToken string  `json:"access_token"`
+		ExpiresIn   float64 `json:"expires_in"`
+	}
+	err = json.NewDecoder(resp.Body).Decode(&body)
+	if err != nil {
+		return "", time.Time{}, fmt.Errorf("token response: %w", err)
+	}
+	if body.AccessToken == "" {
+		return "", time.Time{}, fmt.Errorf("token response has no access_token")
+	}
+
+	expiry := time.Time{}
+	if body.ExpiresIn > 0 {
+		expiry = time.Now().Add(time.Duration(body.ExpiresIn * float64(time.Second)))
+	}
+	return body.AccessToken, expiry, nil
+}
+
+func (source *tokenSource) reset() {
+	source.mutex.Lock()
+	defer source.mutex.Unlock()
+	source.value = ""
+	source.expiry = time.Time{}
+}
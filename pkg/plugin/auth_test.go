@@ -0,0 +1,183 @@
+package plugin
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend/httpclient"
+)
+
+func TestHeaderAuth_ApiKey(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-Tenant-Key") != "secret" {
+			t.Errorf("Expected API key header, got %q", r.Header.Get("X-Tenant-Key"))
+		}
+		if r.Header.Get("Authorization") != "" {
+			t.Errorf("Expected no Authorization header, got %q", r.Header.Get("Authorization"))
+		}
+	}))
+	defer server.Close()
+
+	auth, err := newHeaderAuth(
+		Options{AuthMode: authModeApiKey, ApiKeyHeader: "X-Tenant-Key"},
+		map[string]string{"apiKey": "secret"},
+		http.DefaultClient,
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	httpClient := newTestAuthHttpClient(auth, t)
+
+	req, _ := http.NewRequest("GET", server.URL, nil)
+	req.Header.Set("Authorization", "BEARER authToken=")
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+}
+
+func TestHeaderAuth_TokenEndpoint(t *testing.T) {
+	tokenRequests := 0
+	tokenServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		tokenRequests++
+		if err := r.ParseForm(); err != nil {
+			t.Fatal(err)
+		}
+		if r.Form.Get("grant_type") != "client_credentials" || r.Form.Get("client_id") != "grafana" || r.Form.Get("client_secret") != "secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		fmt.Fprintf(w, `{"access_token": "token-%d", "expires_in": 3600}`, tokenRequests)
+	}))
+	defer tokenServer.Close()
+
+	var authorization string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		authorization = r.Header.Get("Authorization")
+	}))
+	defer server.Close()
+
+	auth, err := newHeaderAuth(
+		Options{AuthMode: authModeBearer, TokenUrl: tokenServer.URL, ClientId: "grafana"},
+		map[string]string{"clientSecret": "secret"},
+		http.DefaultClient,
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	httpClient := newTestAuthHttpClient(auth, t)
+
+	// The token is cached across requests
+	for range 2 {
+		resp, err := httpClient.Get(server.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if authorization != "Bearer token-1" {
+			t.Errorf("Expected first token, got %q", authorization)
+		}
+	}
+	if tokenRequests != 1 {
+		t.Errorf("Expected 1 token request, got %d", tokenRequests)
+	}
+
+	// Opening the client re-fetches the token
+	err = headerAuthClient{auth: auth}.Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := httpClient.Get(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if authorization != "Bearer token-2" {
+		t.Errorf("Expected second token, got %q", authorization)
+	}
+}
+
+func TestTokenSource_Cancel(t *testing.T) {
+	var tokenRequests atomic.Int32
+	firstRequest := make(chan struct{})
+	release := make(chan struct{})
+	tokenServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		count := tokenRequests.Add(1)
+		if count == 1 {
+			// Hang until the request is cancelled
+			close(firstRequest)
+			select {
+			case <-r.Context().Done():
+			case <-release:
+			}
+			return
+		}
+		fmt.Fprintf(w, `{"access_token": "token-%d", "expires_in": 3600}`, count)
+	}))
+	defer tokenServer.Close()
+	defer close(release)
+
+	source := &tokenSource{httpClient: http.DefaultClient, url: tokenServer.URL}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancelled := make(chan error)
+	go func() {
+		_, err := source.token(ctx)
+		cancelled <- err
+	}()
+	<-firstRequest
+
+	// Requests waiting for the cancelled fetch fetch the token again, rather than failing
+	var waiters sync.WaitGroup
+	tokens := make([]string, 3)
+	errs := make([]error, 3)
+	for i := range tokens {
+		waiters.Add(1)
+		go func() {
+			defer waiters.Done()
+			tokens[i], errs[i] = source.token(context.Background())
+		}()
+	}
+
+	cancel()
+	if err := <-cancelled; !errors.Is(err, context.Canceled) {
+		t.Errorf("Expected the cancelled request to fail with context.Canceled, got %v", err)
+	}
+	waiters.Wait()
+	for i := range tokens {
+		if errs[i] != nil || tokens[i] != "token-2" {
+			t.Errorf("Expected the second token, got %q, %v", tokens[i], errs[i])
+		}
+	}
+	if tokenRequests.Load() != 2 {
+		t.Errorf("Expected 2 token requests, got %d", tokenRequests.Load())
+	}
+}
+
+func TestNewHeaderAuth_MissingSecret(t *testing.T) {
+	_, err := newHeaderAuth(Options{AuthMode: authModeBearer}, map[string]string{}, http.DefaultClient)
+	if err == nil {
+		t.Error("Expected an error when no bearer token or token URL is configured")
+	}
+	_, err = newHeaderAuth(Options{AuthMode: authModeApiKey}, map[string]string{}, http.DefaultClient)
+	if err == nil {
+		t.Error("Expected an error when no API key is configured")
+	}
+}
+
+func newTestAuthHttpClient(auth *headerAuth, t *testing.T) *http.Client {
+	httpClient, err := httpclient.New(httpclient.Options{
+		Middlewares: []httpclient.Middleware{auth.middleware()},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return httpClient
+}
@@ -4,19 +4,26 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
+	"net/http"
+	"slices"
 	"sort"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/NeedleInAJayStack/haystack"
+	"github.com/NeedleInAJayStack/haystack-datasource/pkg/filter"
 	"github.com/NeedleInAJayStack/haystack/client"
 	"github.com/NeedleInAJayStack/haystack/io"
 	"github.com/grafana/grafana-plugin-sdk-go/backend"
 	"github.com/grafana/grafana-plugin-sdk-go/backend/httpclient"
 	"github.com/grafana/grafana-plugin-sdk-go/backend/instancemgmt"
 	"github.com/grafana/grafana-plugin-sdk-go/backend/log"
+	"github.com/grafana/grafana-plugin-sdk-go/backend/resource/httpadapter"
+	"github.com/grafana/grafana-plugin-sdk-go/backend/tracing"
 	"github.com/grafana/grafana-plugin-sdk-go/data"
+	"go.opentelemetry.io/otel/trace"
 )
 
 // Make sure Datasource implements required interfaces. This is important to do
@@ -27,9 +34,13 @@ import (
 var (
 	_ backend.QueryDataHandler      = (*Datasource)(nil)
 	_ backend.CheckHealthHandler    = (*Datasource)(nil)
+	_ backend.CallResourceHandler   = (*Datasource)(nil)
 	_ instancemgmt.InstanceDisposer = (*Datasource)(nil)
 )
 
+// hisReadFilterConcurrency is the maximum number of points a hisReadFilter query reads at once
+const hisReadFilterConcurrency = 10
+
 // NewDatasource creates a new datasource instance.
 func NewDatasource(ctx context.Context, settings backend.DataSourceInstanceSettings) (instancemgmt.Instance, error) {
 	log.DefaultLogger.Debug("NewDatasource called")
@@ -40,47 +51,166 @@ func NewDatasource(ctx context.Context, settings backend.DataSourceInstanceSetti
 	if err != nil {
 		return nil, fmt.Errorf("datasource options: %w", err)
 	}
-	url := options.Url
-	username := options.Username
 
 	// settings contains secure inputs in .DecryptedSecureJSONData in a string:string map
 	password := settings.DecryptedSecureJSONData["password"]
 
-	httpClientOptions, err := settings.HTTPClientOptions(ctx)
+	httpClientOptions, err := httpClientOptions(ctx, settings, options)
 	if err != nil {
-		return nil, fmt.Errorf("http client options: %w", err)
+		return nil, err
 	}
-	httpClientOptions.TLS = &httpclient.TLSOptions{InsecureSkipVerify: options.SkipTlsVerify}
-	httpClient, err := httpclient.New(httpClientOptions)
-	if err != nil {
-		return nil, fmt.Errorf("new http client: %w", err)
+
+	factory := clientFactory{
+		urls:              options.urls(),
+		username:          options.Username,
+		password:          password,
+		forwardToken:      options.ForwardOauthIdentity,
+		httpClientOptions: httpClientOptions,
+	}
+	if options.AuthMode != "" && options.AuthMode != authModeBasic {
+		httpClient, err := httpclient.New(httpClientOptions)
+		if err != nil {
+			return nil, fmt.Errorf("new http client: %w", err)
+		}
+		factory.auth, err = newHeaderAuth(options, settings.DecryptedSecureJSONData, httpClient)
+		if err != nil {
+			return nil, fmt.Errorf("auth: %w", err)
+		}
 	}
-	client := client.NewClientFromHTTP(url, username, password, httpClient)
-	err = client.Open()
+
+	// The client is opened on first use, so that an unreachable server doesn't prevent the datasource from starting
+	client, err := factory.newClient(nil)
 	if err != nil {
-		return nil, fmt.Errorf("haystack client opening: %w", err)
+		return nil, err
+	}
+	metrics := newMetricLabels(settings.UID)
+	datasource := Datasource{
+		metrics:       metrics,
+		client:        client,
+		limiter:       newRequestLimiter(metrics, options.RateLimit, options.RateLimitBurst, options.MaxConcurrentRequests),
+		treeCache:     treeCache{records: treeCacheRecords.WithLabelValues(metrics.values()...)},
+		actionOptions: newActionOptions(options),
+	}
+	if options.ForwardOauthIdentity || options.UserHeader != "" {
+		datasource.users = newUserPool(metrics, factory, options.UserHeader, datasource.limiter, datasource.treeCache.records)
 	}
-	datasource := Datasource{client: client}
 	return &datasource, nil
 }
 
+// httpClientOptions returns the options for the datasource's http clients. The TLS options from the settings,
+// like the CA and client certificates, are kept and combined with the datasource's TLS options.
+func httpClientOptions(ctx context.Context, settings backend.DataSourceInstanceSettings, options Options) (httpclient.Options, error) {
+	httpClientOptions, err := settings.HTTPClientOptions(ctx)
+	if err != nil {
+		return httpclient.Options{}, fmt.Errorf("http client options: %w", err)
+	}
+	if httpClientOptions.TLS == nil {
+		httpClientOptions.TLS = &httpclient.TLSOptions{}
+	}
+	httpClientOptions.TLS.InsecureSkipVerify = httpClientOptions.TLS.InsecureSkipVerify || options.SkipTlsVerify
+	if options.ServerName != "" {
+		httpClientOptions.TLS.ServerName = options.ServerName
+	}
+	return httpClientOptions, nil
+}
+
 // Datasource is an example datasource which can respond to data queries, reports
 // its health and has streaming skills.
 type Datasource struct {
-	client HaystackClient
+	metrics   metricLabels // Labels the metrics of the instance
+	client    HaystackClient
+	limiter   *requestLimiter // Limits the requests to the server, shared with the user datasources. Nil if unlimited
+	treeCache treeCache
+	tagsCache tagsCache
+
+	connMutex sync.Mutex
+	connected bool // Whether the client has been opened successfully
+
+	users *userPool // Datasources for each Grafana user, or nil if the user's identity isn't forwarded
+
+	actionOptions actionOptions
 }
 
 type Options struct {
-	Url           string `json:"url"`
-	Username      string `json:"username"`
-	SkipTlsVerify bool   `json:"skipTlsVerify"`
+	Url           string   `json:"url"`
+	Urls          []string `json:"urls"` // Fallback URLs, in order of preference, used when the primary URL fails
+	Username      string   `json:"username"`
+	SkipTlsVerify bool     `json:"skipTlsVerify"`
+	AuthMode      string   `json:"authMode"`     // "basic", "bearer", or "apiKey". Defaults to "basic"
+	ApiKeyHeader  string   `json:"apiKeyHeader"` // The header that contains the API key. Defaults to "X-API-Key"
+	TokenUrl      string   `json:"tokenUrl"`     // An OAuth 2.0 token endpoint used to fetch bearer tokens
+	ClientId      string   `json:"clientId"`
+	TokenScope    string   `json:"tokenScope"`
+
+	// The CA certificate, client certificate, and client key are read by the SDK from the `tlsCACert`,
+	// `tlsClientCert`, and `tlsClientKey` secure settings, when `tlsAuthWithCACert` or `tlsAuth` is set.
+	TlsAuth           bool   `json:"tlsAuth"`           // Authenticate using a client certificate
+	TlsAuthWithCACert bool   `json:"tlsAuthWithCACert"` // Verify the server using a custom CA certificate
+	ServerName        string `json:"serverName"`        // Overrides the server name used to verify the server certificate
+
+	// Limits on the requests to the server, shared by all queries and users. Zero is unlimited.
+	RateLimit             float64 `json:"rateLimit"`      // Requests per second
+	RateLimitBurst        int     `json:"rateLimitBurst"` // Requests that may exceed the rate in a burst. Defaults to the rate
+	MaxConcurrentRequests int     `json:"maxConcurrentRequests"`
+
+	// Custom headers (`httpHeaderName1`, `httpHeaderName2`, ... with secure `httpHeaderValue1`, ...) and the secure
+	// SOCKS proxy (`enableSecureSocksProxy`) are also read by the SDK, and applied to every request
+	ForwardOauthIdentity bool   `json:"oauthPassThru"` // Authenticate using the Grafana user's OAuth token instead of the configured credentials
+	UserHeader           string `json:"userHeader"`    // If set, the Grafana user's login is sent in this header
+
+	// Actions, like commanding equipment, may be listed and invoked by Grafana users with at least the ActionsRole
+	EnableActions bool   `json:"enableActions"`
+	ActionsRole   string `json:"actionsRole"` // "Viewer", "Editor", or "Admin". Defaults to "Editor"
+}
+
+// urls returns the primary URL followed by the fallback URLs, without blanks or duplicates
+func (options Options) urls() []string {
+	urls := []string{}
+	for _, url := range append([]string{options.Url}, options.Urls...) {
+		url = strings.TrimSpace(url)
+		if url != "" && !slices.Contains(urls, url) {
+			urls = append(urls, url)
+		}
+	}
+	if len(urls) == 0 {
+		// Keep the previous behavior of creating a client that fails on use
+		urls = append(urls, options.Url)
+	}
+	return urls
 }
 
 // Dispose here tells plugin SDK that plugin wants to clean up resources when a new instance
 // created. As soon as datasource settings change detected by SDK old datasource instance will
 // be disposed and a new one will be created using NewSampleDatasource factory function.
 func (datasource *Datasource) Dispose() {
-	datasource.client.Close()
+	datasource.close()
+	if datasource.users != nil {
+		datasource.users.close()
+	}
+	datasource.metrics.delete()
+}
+
+// CallResource handles resource calls sent from Grafana to the plugin.
+// The supported routes are:
+//   - POST /variables: runs a variable query. See VariableRequest
+//   - GET /tags: lists the tags defined by the server, for autocompletion. See TagSuggestion
+//   - GET /actions?id=<id>: lists the actions of a record, if actions are enabled
+//   - POST /actions: invokes an action on a record, if actions are enabled. See ActionRequest
+func (datasource *Datasource) CallResource(ctx context.Context, req *backend.CallResourceRequest, sender backend.CallResourceResponseSender) error {
+	// The user datasources don't have the settings, so they are read first
+	actionOptions := datasource.actionOptions
+	datasource, release, err := datasource.forUser(req.PluginContext.User, req.GetHTTPHeader(backend.OAuthIdentityTokenHeaderName))
+	if err != nil {
+		log.DefaultLogger.Error(err.Error())
+		return sender.Send(&backend.CallResourceResponse{Status: http.StatusUnauthorized, Body: []byte(err.Error())})
+	}
+	defer release()
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/variables", datasource.handleVariables)
+	mux.HandleFunc("/tags", datasource.handleTags)
+	mux.HandleFunc("/actions", datasource.handleActions(actionOptions, req.PluginContext.User))
+	return httpadapter.New(mux).CallResource(ctx, req, sender)
 }
 
 // QueryData handles multiple queries and returns multiple responses.
@@ -91,32 +221,103 @@ func (datasource *Datasource) QueryData(ctx context.Context, req *backend.QueryD
 	// when logging at a non-Debug level, make sure you don't include sensitive information in the message
 	// (like the *backend.QueryDataRequest)
 	log.DefaultLogger.Debug("QueryData called", "numQueries", len(req.Queries))
+	ctx, span := startSpan(ctx, "QueryData", attributeQueries.Int(len(req.Queries)))
+	defer span.End()
 
 	// create response struct
 	response := backend.NewQueryDataResponse()
 
-	// loop over queries and execute them individually.
+	// make the queries on behalf of the Grafana user, if configured
+	datasource, release, err := datasource.forUser(req.PluginContext.User, req.GetHTTPHeader(backend.OAuthIdentityTokenHeaderName))
+	if err != nil {
+		log.DefaultLogger.Error(err.Error())
+		for _, query := range req.Queries {
+			response.Responses[query.RefID] = backend.ErrDataResponse(backend.StatusUnauthorized, fmt.Sprintf("Identity failure: %v", err.Error()))
+		}
+		return response, nil
+	}
+
+	// execute the queries concurrently. Requests to the server are limited by the datasource's requestLimiter.
+	type queryResult struct {
+		refID    string
+		response backend.DataResponse
+	}
+	// Buffered so that queries that finish after cancellation don't block
+	results := make(chan queryResult, len(req.Queries))
+	var queries sync.WaitGroup
 	for _, query := range req.Queries {
-		queryResponse := datasource.query(ctx, req.PluginContext, query)
+		queries.Add(1)
+		go func() {
+			defer queries.Done()
+			results <- queryResult{refID: query.RefID, response: datasource.safeQuery(ctx, req.PluginContext, query)}
+		}()
+	}
+	// The user's datasource is released once every query is done with it, which may be after cancellation
+	go func() {
+		queries.Wait()
+		release()
+	}()
 
-		// save the response in a hashmap
-		// based on with RefID as identifier
-		response.Responses[query.RefID] = queryResponse
+	for range req.Queries {
+		select {
+		case result := <-results:
+			// save the response in a hashmap
+			// based on with RefID as identifier
+			response.Responses[result.refID] = result.response
+		case <-ctx.Done():
+			log.DefaultLogger.Debug("QueryData cancelled", "error", ctx.Err())
+			for _, query := range req.Queries {
+				if _, ok := response.Responses[query.RefID]; !ok {
+					response.Responses[query.RefID] = backend.ErrDataResponse(backend.StatusTimeout, fmt.Sprintf("Query cancelled: %v", ctx.Err()))
+				}
+			}
+			return response, nil
+		}
 	}
 
 	return response, nil
 }
 
+// safeQuery runs the query, unless the context has been cancelled. A panic is returned as an error response,
+// so that it doesn't affect the other queries in the request.
+func (datasource *Datasource) safeQuery(ctx context.Context, pCtx backend.PluginContext, query backend.DataQuery) (response backend.DataResponse) {
+	ctx, span := startSpan(ctx, "query", attributeRefID.String(query.RefID))
+	defer func() { endQuerySpan(span, response) }()
+	if ctx.Err() != nil {
+		return backend.ErrDataResponse(backend.StatusTimeout, fmt.Sprintf("Query cancelled: %v", ctx.Err()))
+	}
+	defer func() {
+		if recovered := recover(); recovered != nil {
+			log.DefaultLogger.Error("Query panicked", "refId", query.RefID, "error", recovered)
+			response = backend.ErrDataResponse(backend.StatusInternal, fmt.Sprintf("Query failure: %v", recovered))
+		}
+	}()
+	return datasource.query(ctx, pCtx, query)
+}
+
 type QueryModel struct {
-	Type          string  `json:"type"`
-	Nav           *string `json:"nav"` // A zinc-encoded Ref or null
-	Eval          string  `json:"eval"`
-	HisRead       string  `json:"hisRead"`
-	HisReadFilter string  `json:"hisReadFilter"`
-	Read          string  `json:"read"`
+	Type              string  `json:"type"`
+	Nav               *string `json:"nav"` // A zinc-encoded Ref or null
+	Eval              string  `json:"eval"`
+	HisRead           string  `json:"hisRead"`
+	HisReadFilter     string  `json:"hisReadFilter"`
+	Read              string  `json:"read"`
+	Annotations       string  `json:"annotations"`
+	AnnotationsSource string  `json:"annotationsSource"` // "read", "eval", or "sparks". Defaults to "read"
+	Sites             string  `json:"sites"`
+	SitesStatus       string  `json:"sitesStatus"`      // A filter for records that contribute to each site's status
+	Tree              string  `json:"tree"`             // The id of the root record, or empty for the full tree
+	TreeFilter        string  `json:"treeFilter"`       // A filter applied to the cached tree records, or empty for all records
+	HisLocalTime      bool    `json:"hisLocalTime"`     // Shift history timestamps to the point's local wall-clock time, as UTC
+	MixedColumns      string  `json:"mixedColumns"`     // "string", "split", or "dominant". Defaults to "string"
+	Quality           bool    `json:"quality"`          // Add a quality field for columns with NA or Remove values
+	HisNullBadStatus  bool    `json:"hisNullBadStatus"` // Replace history values with a fault or stale status with null
+	Defs              string  `json:"defs"`             // A filter for the defs, or empty for all defs
+	Libs              string  `json:"libs"`             // A filter for the libs, or empty for all libs
+	Filetypes         string  `json:"filetypes"`        // A filter for the filetypes, or empty for all filetypes
 }
 
-func (datasource *Datasource) query(ctx context.Context, pCtx backend.PluginContext, query backend.DataQuery) backend.DataResponse {
+func (datasource *Datasource) query(ctx context.Context, pCtx backend.PluginContext, query backend.DataQuery) (response backend.DataResponse) {
 	// Unmarshal the JSON into our queryModel.
 	var model QueryModel
 
@@ -126,41 +327,61 @@ func (datasource *Datasource) query(ctx context.Context, pCtx backend.PluginCont
 		return backend.ErrDataResponse(backend.StatusBadRequest, fmt.Sprintf("json unmarshal failure: %v", err.Error()))
 	}
 
-	variables := map[string]string{
-		"$__timeRange_start": haystack.NewDateTimeFromGo(query.TimeRange.From.UTC()).ToAxon(),
-		"$__timeRange_end":   haystack.NewDateTimeFromGo(query.TimeRange.To.UTC()).ToAxon(),
-		"$__maxDataPoints":   strconv.FormatInt(query.MaxDataPoints, 10),
-		"$__interval":        haystack.NewNumber(query.Interval.Minutes(), "min").ToZinc(),
-	}
+	variables := queryVariables(query)
+	options := frameOptions{mixedColumns: model.MixedColumns, quality: model.Quality}
+	trace.SpanFromContext(ctx).SetAttributes(attributeQueryType.String(model.Type))
+
+	// Describe what ran in the frame metadata, for the query inspector and the default panel
+	ctx, stats := withQueryStats(ctx)
+	var meta queryMeta
+	defer func() { meta.apply(response, stats) }()
 
 	switch model.Type {
 	case "":
 		// If no type is specified, just return an empty response.
-		return responseFromGrids([]haystack.Grid{})
+		return responseFromGrids([]haystack.Grid{}, options)
 	case "ops":
-		ops, err := datasource.ops()
+		meta = queryMeta{executed: "ops", frameType: data.FrameTypeTable, visualization: data.VisTypeTable}
+		ops, err := datasource.ops(ctx)
 		if err != nil {
 			log.DefaultLogger.Error(err.Error())
 			return backend.ErrDataResponse(backend.StatusBadRequest, fmt.Sprintf("Ops failure: %v", err.Error()))
 		}
-		return responseFromGrids([]haystack.Grid{ops})
+		return responseFromGrids([]haystack.Grid{ops}, options)
 	case "nav":
-		nav, err := datasource.nav(model.Nav)
+		meta = queryMeta{frameType: data.FrameTypeTable, visualization: data.VisTypeTable}
+		if model.Nav != nil {
+			meta.executed = *model.Nav
+		}
+		nav, err := datasource.nav(ctx, model.Nav)
 		if err != nil {
 			log.DefaultLogger.Error(err.Error())
 			return backend.ErrDataResponse(backend.StatusBadRequest, fmt.Sprintf("Nav failure: %v", err.Error()))
 		}
-		return responseFromGrids([]haystack.Grid{nav})
+		return responseFromGrids([]haystack.Grid{nav}, options)
 	case "eval":
-		eval, err := datasource.eval(model.Eval, variables)
+		meta = queryMeta{executed: interpolate(model.Eval, variables)}
+		eval, err := datasource.eval(ctx, model.Eval, variables)
 		if err != nil {
 			log.DefaultLogger.Error(err.Error())
 			return backend.ErrDataResponse(backend.StatusBadRequest, fmt.Sprintf("Eval failure: %v", err.Error()))
 		}
-		return responseFromGrids([]haystack.Grid{eval})
+		return responseFromGrids([]haystack.Grid{eval}, options)
 	case "hisRead":
+		options.hisStatus = true
+		options.hisNullBadStatus = model.HisNullBadStatus
 		refStr := model.HisRead
-		points, err := datasource.readById(refStr, variables)
+		meta = queryMeta{
+			executed: fmt.Sprintf(
+				"hisRead(@%s, %s..%s)",
+				interpolate(refStr, variables),
+				variables["$__timeRange_start"],
+				variables["$__timeRange_end"],
+			),
+			frameType:     data.FrameTypeTimeSeriesWide,
+			visualization: data.VisTypeGraph,
+		}
+		points, err := datasource.readById(ctx, refStr, variables)
 		if err != nil {
 			log.DefaultLogger.Error(err.Error())
 			return backend.ErrDataResponse(backend.StatusBadRequest, fmt.Sprintf("ReadById failure: %v", err.Error()))
@@ -169,12 +390,12 @@ func (datasource *Datasource) query(ctx context.Context, pCtx backend.PluginCont
 			return backend.ErrDataResponse(backend.StatusBadRequest, fmt.Sprintf("Id not found: %v", refStr))
 		}
 		point := points.RowAt(0)
-		hisRead, err := datasource.hisRead(point, query.TimeRange)
+		hisRead, err := datasource.hisRead(ctx, point, query.TimeRange)
 		if err != nil {
 			log.DefaultLogger.Error(err.Error())
 			return backend.ErrDataResponse(backend.StatusBadRequest, fmt.Sprintf("HisRead failure: %v", err.Error()))
 		}
-		response := responseFromGrids([]haystack.Grid{hisRead})
+		response := responseFromGrids([]haystack.Grid{hisRead}, options)
 		// Make the display name on the "val" field the name of the point.
 		for _, frame := range response.Frames {
 			for _, field := range frame.Fields {
@@ -182,16 +403,28 @@ func (datasource *Datasource) query(ctx context.Context, pCtx backend.PluginCont
 					field.Config.DisplayName = frame.Name
 				}
 			}
+			if model.HisLocalTime {
+				shiftToWallClock(frame)
+			}
 		}
 		return response
 
 	case "hisReadFilter":
-		pointsGrid, readErr := datasource.read(model.HisReadFilter+" and his", variables)
+		options.hisStatus = true
+		options.hisNullBadStatus = model.HisNullBadStatus
+		filterStr, readErr := andFilter(model.HisReadFilter, filter.Has{Path: filter.Path{"his"}}, variables)
+		if readErr != nil {
+			log.DefaultLogger.Error(readErr.Error())
+			return backend.ErrDataResponse(backend.StatusBadRequest, fmt.Sprintf("HisReadFilter failure: %v", readErr.Error()))
+		}
+		meta = queryMeta{executed: filterStr, frameType: data.FrameTypeTimeSeriesMulti, visualization: data.VisTypeGraph}
+		pointsGrid, readErr := datasource.read(ctx, filterStr, map[string]string{})
 		if readErr != nil {
 			log.DefaultLogger.Error(readErr.Error())
 			return backend.ErrDataResponse(backend.StatusBadRequest, fmt.Sprintf("HisReadFilter failure: %v", readErr.Error()))
 		}
 		points := pointsGrid.Rows()
+		hisReadFilterPoints.WithLabelValues(datasource.metrics.values()...).Observe(float64(len(points)))
 		pointMax := 300
 		if len(points) == 0 {
 			errMsg := fmt.Sprintf("Query returned no historized records")
@@ -204,25 +437,39 @@ func (datasource *Datasource) query(ctx context.Context, pCtx backend.PluginCont
 			return backend.ErrDataResponse(backend.StatusBadRequest, errMsg)
 		}
 
-		// Read all the points in parallel using goroutines.
-		hisReadChannel := make(chan haystack.Grid)
+		// Read the points in parallel using goroutines, at most hisReadFilterConcurrency at a time.
+		hisReadChannel := make(chan haystack.Grid, len(points))
+		reading := make(chan struct{}, hisReadFilterConcurrency)
 		for _, point := range points {
 			go func() {
-				hisRead, err := datasource.hisRead(point, query.TimeRange)
+				id, _ := point.Get("id").(haystack.Ref)
+				ctx, span := startSpan(ctx, "hisReadFilter point", attributePointID.String(id.Id()))
+				defer span.End()
+				select {
+				case reading <- struct{}{}:
+					defer func() { <-reading }()
+				case <-ctx.Done():
+					// The query was cancelled, so the remaining points aren't read
+					tracing.Error(span, ctx.Err())
+					hisReadChannel <- haystack.EmptyGrid()
+					return
+				}
+				hisRead, err := datasource.hisRead(ctx, point, query.TimeRange)
 				if err != nil {
 					log.DefaultLogger.Error(err.Error())
+					tracing.Error(span, err)
 				}
 				hisReadChannel <- hisRead // hisRead is empty under error condition
 			}()
 		}
 
 		grids := []haystack.Grid{}
-		for _ = range len(points) {
+		for range len(points) {
 			grid := <-hisReadChannel
 			grids = append(grids, grid)
 		}
 
-		response := responseFromGrids(grids)
+		response := responseFromGrids(grids, options)
 		// Make the display name on the "val" fields the names of the points.
 		for _, frame := range response.Frames {
 			for _, field := range frame.Fields {
@@ -230,15 +477,77 @@ func (datasource *Datasource) query(ctx context.Context, pCtx backend.PluginCont
 					field.Config.DisplayName = frame.Name
 				}
 			}
+			if model.HisLocalTime {
+				shiftToWallClock(frame)
+			}
 		}
 		return response
 	case "read":
-		read, err := datasource.read(model.Read, variables)
+		meta = queryMeta{executed: interpolate(model.Read, variables), frameType: data.FrameTypeTable, visualization: data.VisTypeTable}
+		read, err := datasource.read(ctx, model.Read, variables)
 		if err != nil {
 			log.DefaultLogger.Error(err.Error())
 			return backend.ErrDataResponse(backend.StatusBadRequest, fmt.Sprintf("Read failure: %v", err.Error()))
 		}
-		return responseFromGrids([]haystack.Grid{read})
+		return responseFromGrids([]haystack.Grid{read}, options)
+	case "annotations":
+		meta = queryMeta{executed: interpolate(model.Annotations, variables), frameType: data.FrameTypeTable}
+		annotations, err := datasource.annotations(ctx, model.AnnotationsSource, model.Annotations, variables)
+		if err != nil {
+			log.DefaultLogger.Error(err.Error())
+			return backend.ErrDataResponse(backend.StatusBadRequest, fmt.Sprintf("Annotations failure: %v", err.Error()))
+		}
+		var response backend.DataResponse
+		response.Frames = data.Frames{annotationFrameFromGrid(annotations, query.TimeRange)}
+		response.Status = backend.StatusOK
+		return response
+	case "sites":
+		meta = queryMeta{executed: interpolate(model.Sites, variables), frameType: data.FrameTypeTable}
+		if model.SitesStatus != "" {
+			meta.executed += "\n" + interpolate(model.SitesStatus, variables)
+		}
+		sites, status, err := datasource.sites(ctx, model.Sites, model.SitesStatus, variables)
+		if err != nil {
+			log.DefaultLogger.Error(err.Error())
+			return backend.ErrDataResponse(backend.StatusBadRequest, fmt.Sprintf("Sites failure: %v", err.Error()))
+		}
+		var response backend.DataResponse
+		response.Frames = data.Frames{sitesFrameFromGrid(sites, status)}
+		response.Status = backend.StatusOK
+		return response
+	case "tree":
+		meta = queryMeta{executed: treeFilter, frameType: data.FrameTypeTable}
+		nodes, err := datasource.treeNodes(ctx)
+		if err != nil {
+			log.DefaultLogger.Error(err.Error())
+			return backend.ErrDataResponse(backend.StatusBadRequest, fmt.Sprintf("Tree failure: %v", err.Error()))
+		}
+		rootId := interpolate(model.Tree, variables)
+		// Accept zinc-encoded Refs, like `@abc "Site A"`
+		rootId, _, _ = strings.Cut(strings.TrimPrefix(strings.TrimSpace(rootId), "@"), " ")
+		if strings.TrimSpace(model.TreeFilter) != "" {
+			node, err := filter.Parse(interpolate(model.TreeFilter, variables))
+			if err != nil {
+				return backend.ErrDataResponse(backend.StatusBadRequest, fmt.Sprintf("Tree failure: %v", err.Error()))
+			}
+			nodes = filterTreeNodes(nodes, node)
+		}
+		var response backend.DataResponse
+		response.Frames = data.Frames{treeFrameFromNodes(nodes, rootId)}
+		response.Status = backend.StatusOK
+		return response
+	case "defs", "libs", "filetypes":
+		filterStr := map[string]string{"defs": model.Defs, "libs": model.Libs, "filetypes": model.Filetypes}[model.Type]
+		meta = queryMeta{executed: interpolate(filterStr, variables), frameType: data.FrameTypeTable, visualization: data.VisTypeTable}
+		defs, err := datasource.defs(ctx, model.Type, filterStr, variables)
+		if err != nil {
+			log.DefaultLogger.Error(err.Error())
+			return backend.ErrDataResponse(backend.StatusBadRequest, fmt.Sprintf("Defs failure: %v", err.Error()))
+		}
+		var response backend.DataResponse
+		response.Frames = data.Frames{defsFrameFromGrid(model.Type, defs)}
+		response.Status = backend.StatusOK
+		return response
 	default:
 		warnMsg := fmt.Sprintf("Invalid type %s, returning empty Grid", model.Type)
 		log.DefaultLogger.Warn(warnMsg)
@@ -246,11 +555,29 @@ func (datasource *Datasource) query(ctx context.Context, pCtx backend.PluginCont
 	}
 }
 
+// queryVariables returns the built-in variables available to the query, already encoded as Axon
+func queryVariables(query backend.DataQuery) map[string]string {
+	return map[string]string{
+		"$__timeRange_start": haystack.NewDateTimeFromGo(query.TimeRange.From.UTC()).ToAxon(),
+		"$__timeRange_end":   haystack.NewDateTimeFromGo(query.TimeRange.To.UTC()).ToAxon(),
+		"$__maxDataPoints":   strconv.FormatInt(query.MaxDataPoints, 10),
+		"$__interval":        haystack.NewNumber(query.Interval.Minutes(), "min").ToZinc(),
+	}
+}
+
+// interpolate replaces the query variables in the string
+func interpolate(str string, variables map[string]string) string {
+	for name, val := range variables {
+		str = strings.ReplaceAll(str, name, val)
+	}
+	return str
+}
+
 // Creates a response from the input grids. The frames in the result are sorted by display name.
-func responseFromGrids(grids []haystack.Grid) backend.DataResponse {
+func responseFromGrids(grids []haystack.Grid, options frameOptions) backend.DataResponse {
 	frames := data.Frames{}
 	for _, grid := range grids {
-		frame := dataFrameFromGrid(grid)
+		frame := dataFrameFromGrid(grid, options)
 		frames = append(frames, frame)
 	}
 
@@ -268,46 +595,38 @@ func responseFromGrids(grids []haystack.Grid) backend.DataResponse {
 // The main use case for these health checks is the test button on the
 // datasource configuration page which allows users to verify that
 // a datasource is working as expected.
-func (datasource *Datasource) CheckHealth(_ context.Context, req *backend.CheckHealthRequest) (*backend.CheckHealthResult, error) {
+func (datasource *Datasource) CheckHealth(ctx context.Context, req *backend.CheckHealthRequest) (*backend.CheckHealthResult, error) {
 	// when logging at a non-Debug level, make sure you don't include sensitive information in the message
 	// (like the *backend.QueryDataRequest)
 	log.DefaultLogger.Debug("CheckHealth called")
 
-	_, err := datasource.client.About()
-	if err != nil {
-		return &backend.CheckHealthResult{
-			Status:  backend.HealthStatusError,
-			Message: err.Error(),
-		}, err
-	}
-
-	return &backend.CheckHealthResult{
-		Status:  backend.HealthStatusOk,
-		Message: "Data source is working",
-	}, nil
+	// Errors are reported in the result, since an error return is shown as a generic plugin failure
+	return datasource.checkHealth(ctx), nil
 }
 
-func (datasource *Datasource) ops() (haystack.Grid, error) {
+func (datasource *Datasource) ops(ctx context.Context) (haystack.Grid, error) {
 	return datasource.withRetry(
+		ctx,
+		"ops",
 		func() (haystack.Grid, error) {
 			return datasource.client.Ops()
 		},
 	)
 }
 
-func (datasource *Datasource) eval(expr string, variables map[string]string) (haystack.Grid, error) {
-	for name, val := range variables {
-		expr = strings.ReplaceAll(expr, name, val)
-	}
+func (datasource *Datasource) eval(ctx context.Context, expr string, variables map[string]string) (haystack.Grid, error) {
+	expr = interpolate(expr, variables)
 
 	return datasource.withRetry(
+		ctx,
+		"eval",
 		func() (haystack.Grid, error) {
 			return datasource.client.Eval(expr)
 		},
 	)
 }
 
-func (datasource *Datasource) hisRead(point haystack.Row, timeRange backend.TimeRange) (haystack.Grid, error) {
+func (datasource *Datasource) hisRead(ctx context.Context, point haystack.Row, timeRange backend.TimeRange) (haystack.Grid, error) {
 	id, idIsRef := point.Get("id").(haystack.Ref)
 	if !idIsRef {
 		return haystack.EmptyGrid(), fmt.Errorf("id is not a Ref")
@@ -329,31 +648,47 @@ func (datasource *Datasource) hisRead(point haystack.Row, timeRange backend.Time
 	}
 
 	return datasource.withRetry(
+		ctx,
+		"hisRead",
 		func() (haystack.Grid, error) {
 			return datasource.client.HisReadAbsDateTime(id, start, end)
 		},
 	)
 }
 
-func (datasource *Datasource) read(filter string, variables map[string]string) (haystack.Grid, error) {
-	for name, val := range variables {
-		filter = strings.ReplaceAll(filter, name, val)
+// read returns the records matching the filter. The filter is validated before it is sent to the server.
+func (datasource *Datasource) read(ctx context.Context, filterStr string, variables map[string]string) (haystack.Grid, error) {
+	filterStr = interpolate(filterStr, variables)
+	_, err := filter.Parse(filterStr)
+	if err != nil {
+		return haystack.EmptyGrid(), err
 	}
 
 	return datasource.withRetry(
+		ctx,
+		"read",
 		func() (haystack.Grid, error) {
-			return datasource.client.Read(filter)
+			return datasource.client.Read(filterStr)
 		},
 	)
 }
 
-func (datasource *Datasource) readById(id string, variables map[string]string) (haystack.Grid, error) {
-	for name, val := range variables {
-		id = strings.ReplaceAll(id, name, val)
+// andFilter returns a filter that matches both the interpolated filter and the clause
+func andFilter(filterStr string, clause filter.Node, variables map[string]string) (string, error) {
+	node, err := filter.Parse(interpolate(filterStr, variables))
+	if err != nil {
+		return "", err
 	}
+	return filter.AndWith(node, clause).String(), nil
+}
+
+func (datasource *Datasource) readById(ctx context.Context, id string, variables map[string]string) (haystack.Grid, error) {
+	id = interpolate(id, variables)
 
 	ref := haystack.NewRef(id, "")
 	return datasource.withRetry(
+		ctx,
+		"readByIds",
 		func() (haystack.Grid, error) {
 			return datasource.client.ReadByIds([]haystack.Ref{ref})
 		},
@@ -362,8 +697,10 @@ func (datasource *Datasource) readById(id string, variables map[string]string) (
 
 // nav returns the grid for the given navId, or the root nav if navId is nil
 // `navId` is expected to be a zinc-encoded Ref
-func (datasource *Datasource) nav(navId *string) (haystack.Grid, error) {
+func (datasource *Datasource) nav(ctx context.Context, navId *string) (haystack.Grid, error) {
 	return datasource.withRetry(
+		ctx,
+		"nav",
 		func() (haystack.Grid, error) {
 			if navId != nil {
 				zincReader := io.ZincReader{}
@@ -381,16 +718,105 @@ func (datasource *Datasource) nav(navId *string) (haystack.Grid, error) {
 	)
 }
 
-// withRetry will retry the given operation if it fails with a 403 or 404 error
+// withRetry records the metrics and span of the op, opens the client if needed, and will retry the given operation if it fails with a 403 or 404 error.
+// If the client has multiple endpoints and the current one is unavailable, it fails over to the next endpoint.
 func (datasource *Datasource) withRetry(
+	ctx context.Context,
+	op string,
+	operation func() (haystack.Grid, error),
+) (result haystack.Grid, err error) {
+	_, span := startSpan(ctx, "haystack."+op, attributeOp.String(op))
+	attempts := 0
+	defer func() { endOpSpan(span, attempts, result, err) }()
+	operation = datasource.instrument(ctx, op, operation, &attempts)
+	failover, isFailover := datasource.client.(*failoverClient)
+	if !isFailover {
+		return datasource.withReconnect(ctx, operation)
+	}
+
+	for range failover.clients {
+		endpoint, _ := failover.endpoint()
+		result, err = datasource.withReconnect(ctx, operation)
+		if !isEndpointFailure(err) {
+			return result, err
+		}
+		failover.next(endpoint, err)
+		// Re-authenticate on the next endpoint
+		datasource.connMutex.Lock()
+		datasource.connected = false
+		datasource.connMutex.Unlock()
+	}
+	return result, err
+}
+
+// withoutRetry records the metrics and span of the op, opens the client if needed, and makes the request once. It
+// is used for requests that aren't safe to repeat, like invoking actions, since a failed request may still have
+// been carried out by the server.
+func (datasource *Datasource) withoutRetry(
+	ctx context.Context,
+	op string,
+	operation func() (haystack.Grid, error),
+) (result haystack.Grid, err error) {
+	_, span := startSpan(ctx, "haystack."+op, attributeOp.String(op))
+	attempts := 0
+	defer func() { endOpSpan(span, attempts, result, err) }()
+	err = datasource.connect(ctx)
+	if err != nil {
+		return haystack.EmptyGrid(), err
+	}
+	return datasource.instrument(ctx, op, operation, &attempts)()
+}
+
+// instrument wraps the operation to record its metrics and query stats, count its attempts, and wait for the
+// request limits. The wrapped operation fails without making a request once the context has been cancelled.
+func (datasource *Datasource) instrument(
+	ctx context.Context,
+	op string,
+	operation func() (haystack.Grid, error),
+	attempts *int,
+) func() (haystack.Grid, error) {
+	stats := queryStatsFromContext(ctx)
+	observed := datasource.observe(op, func() (haystack.Grid, error) {
+		*attempts++
+		// Only the request is timed, not waiting for the limits, to reconnect, or to fail over
+		start := time.Now()
+		defer func() { stats.add(time.Since(start)) }()
+		return operation()
+	})
+	return func() (haystack.Grid, error) {
+		// Don't make further attempts once the query has been cancelled
+		if err := ctx.Err(); err != nil {
+			return haystack.EmptyGrid(), err
+		}
+		release, err := datasource.limiter.acquire(ctx)
+		if err != nil {
+			return haystack.EmptyGrid(), err
+		}
+		defer release()
+		return observed()
+	}
+}
+
+// withReconnect opens the client if needed, and will retry the given operation if it fails with a 403 or 404 error
+func (datasource *Datasource) withReconnect(
+	ctx context.Context,
 	operation func() (haystack.Grid, error),
 ) (haystack.Grid, error) {
+	err := datasource.connect(ctx)
+	if err != nil {
+		return haystack.EmptyGrid(), err
+	}
+
 	result, err := operation()
-	// If the error is a 403 or 404, try to reconnect and try again
+	// If the error is a 403 or 404, the session may have expired or the server restarted, so reconnect and try again
 	switch error := err.(type) {
 	case client.HTTPError:
 		if error.Code == 404 || error.Code == 403 {
-			datasource.client.Open()
+			reauthentications.WithLabelValues(datasource.metrics.values()...).Inc()
+			err = datasource.reconnect(ctx)
+			if err != nil {
+				return haystack.EmptyGrid(), err
+			}
 			return operation()
 		} else {
 			return result, err
@@ -400,120 +826,442 @@ func (datasource *Datasource) withRetry(
 	}
 }
 
+// connect opens the client, unless it has already been opened successfully. If opening fails, it is retried
+// on the next use.
+func (datasource *Datasource) connect(ctx context.Context) error {
+	datasource.connMutex.Lock()
+	defer datasource.connMutex.Unlock()
+	if datasource.connected {
+		return nil
+	}
+	return datasource.open(ctx)
+}
+
+// reconnect re-opens the client, even if it has already been opened
+func (datasource *Datasource) reconnect(ctx context.Context) error {
+	datasource.connMutex.Lock()
+	defer datasource.connMutex.Unlock()
+	return datasource.open(ctx)
+}
+
+// open opens the client, once the request limits allow it. The connMutex must be held.
+func (datasource *Datasource) open(ctx context.Context) error {
+	release, err := datasource.limiter.acquire(ctx)
+	if err != nil {
+		return err
+	}
+	defer release()
+	err = datasource.client.Open()
+	datasource.connected = err == nil
+	if err != nil {
+		log.DefaultLogger.Warn("Failed to open haystack client", "error", err.Error())
+		return fmt.Errorf("haystack client opening: %w", err)
+	}
+	return nil
+}
+
+// close closes the client, if it was opened
+func (datasource *Datasource) close() {
+	datasource.connMutex.Lock()
+	defer datasource.connMutex.Unlock()
+	if datasource.connected {
+		datasource.client.Close()
+		datasource.connected = false
+	} else if failover, isFailover := datasource.client.(*failoverClient); isFailover {
+		// The endpoints weren't opened, but the primary endpoint may still be being checked
+		failover.stopChecks()
+	}
+}
+
 // dataFrameFromGrid converts a haystack grid to a Grafana data frame
-func dataFrameFromGrid(grid haystack.Grid) *data.Frame {
+func dataFrameFromGrid(grid haystack.Grid, options frameOptions) *data.Frame {
 	fields := []*data.Field{}
+	notices := []data.Notice{}
+	columns := columnsFromGrid(grid)
+	if options.hisStatus {
+		columns = withHisStatus(columns, options.hisNullBadStatus)
+	}
 
-	for _, col := range grid.Cols() {
-		columnType := none
-		for _, row := range grid.Rows() {
-			val := row.Get(col.Name())
-			switch val.(type) {
-			case haystack.Null:
+	for _, column := range columns {
+		colFields, notice, missing := fieldsFromColumn(column, options)
+		fields = append(fields, colFields...)
+		if notice != nil {
+			notices = append(notices, *notice)
+		}
+		if options.quality && missing {
+			fields = append(fields, qualityField(column))
+		}
+	}
+
+	frame := data.NewFrame("response", fields...)
+	frameName := disFromMeta(grid.Meta(), "")
+	frame.Name = frameName
+	if custom := customFromMeta(grid.Meta()); custom != nil {
+		frame.Meta = &data.FrameMeta{Custom: custom}
+	}
+	if len(notices) > 0 {
+		frame.AppendNotices(notices...)
+	}
+	return frame
+}
+
+// fieldsFromColumn converts the column to fields, depending on the types of its values. It also returns a notice if
+// values were replaced, and whether the column has NA or Remove values.
+func fieldsFromColumn(column column, options frameOptions) ([]*data.Field, *data.Notice, bool) {
+	counts := map[colType]int{}
+	missing := false
+	for _, val := range column.vals {
+		if valType := colTypeOf(val); valType != none {
+			counts[valType]++
+		}
+		switch val.(type) {
+		case haystack.NA, haystack.Remove:
+			missing = true
+		}
+	}
+	columnType := none
+	for valType := range counts {
+		columnType = valType
+	}
+	if len(counts) > 1 {
+		columnType = mixed
+	}
+
+	if columnType != mixed {
+		return []*data.Field{fieldFromColumn(column, column.name, columnType, false)}, nil, missing
+	}
+	switch options.mixedColumns {
+	case mixedColumnsSplit:
+		// A field for each type, with null where the value has another type
+		fields := []*data.Field{}
+		for _, valType := range mixedColTypes {
+			if counts[valType] == 0 {
 				continue
-			case haystack.DateTime, haystack.Date:
-				if columnType == none || columnType == dateTime {
-					columnType = dateTime
-				} else {
-					columnType = mixed
-				}
+			}
+			field := fieldFromColumn(column, column.name+"_"+valType.suffix(), valType, true)
+			if valType != number {
+				field.Config.Unit = ""
+			}
+			fields = append(fields, field)
+		}
+		return fields, nil, missing
+	case mixedColumnsDominant:
+		dominant := none
+		for _, valType := range mixedColTypes {
+			if counts[valType] > counts[dominant] {
+				dominant = valType
+			}
+		}
+		others := -counts[dominant]
+		for _, count := range counts {
+			others += count
+		}
+		text := fmt.Sprintf("Column %s has mixed types: %d values that aren't %s were replaced with null", column.name, others, dominant.kind())
+		if dominant == str {
+			text = fmt.Sprintf("Column %s has mixed types: %d values that aren't %s were converted to strings", column.name, others, dominant.kind())
+		}
+		notice := data.Notice{Severity: data.NoticeSeverityWarning, Text: text}
+		return []*data.Field{fieldFromColumn(column, column.name, dominant, false)}, &notice, missing
+	default:
+		return []*data.Field{fieldFromColumn(column, column.name, str, false)}, nil, missing
+	}
+}
+
+// qualityField returns a field with the quality of each value in the column: `ok`, `na` for NA values, `remove` for
+// Remove values, or null for null values
+func qualityField(column column) *data.Field {
+	values := []*string{}
+	for _, val := range column.vals {
+		var quality string
+		switch val.(type) {
+		case haystack.Null:
+			values = append(values, nil)
+			continue
+		case haystack.NA:
+			quality = "na"
+		case haystack.Remove:
+			quality = "remove"
+		default:
+			quality = "ok"
+		}
+		values = append(values, &quality)
+	}
+	field := data.NewField(column.name+"_quality", nil, values)
+	field.Config = &data.FieldConfig{DisplayName: disFromMeta(column.meta, column.name) + "_quality"}
+	return field
+}
+
+// fieldFromColumn converts the values of the column to a field of the given type. Values of other types are null,
+// except in string fields, where they are converted to strings unless exclusive is set.
+func fieldFromColumn(column column, name string, columnType colType, exclusive bool) *data.Field {
+	var field *data.Field
+	if columnType == dateTime {
+		values := []*time.Time{}
+		for i, val := range column.vals {
+			switch val := val.(type) {
+			case haystack.DateTime:
+				value := val.ToGo()
+				values = append(values, &value)
+			case haystack.Date:
+				value := startOfDate(val, column.tzs[i])
+				values = append(values, &value)
+			default:
+				values = append(values, nil)
+			}
+		}
+		field = data.NewField(name, nil, values)
+	} else if columnType == number {
+		values := []*float64{}
+		for _, val := range column.vals {
+			switch val := val.(type) {
 			case haystack.Number:
-				if columnType == none || columnType == number {
-					columnType = number
-				} else {
-					columnType = mixed
-				}
+				value := val.Float()
+				values = append(values, &value)
+			default:
+				values = append(values, nil)
+			}
+		}
+		field = data.NewField(name, nil, values)
+	} else if columnType == boolean {
+		values := []*bool{}
+		for _, val := range column.vals {
+			switch val := val.(type) {
 			case haystack.Bool:
-				if columnType == none || columnType == boolean {
-					columnType = boolean
-				} else {
-					columnType = mixed
-				}
+				value := val.ToBool()
+				values = append(values, &value)
 			default:
-				if columnType == none || columnType == str {
-					columnType = str
-				} else {
-					columnType = mixed
-				}
+				values = append(values, nil)
+			}
+		}
+		field = data.NewField(name, nil, values)
+	} else if columnType == timeOfDay {
+		values := []*string{}
+		for _, val := range column.vals {
+			switch val := val.(type) {
+			case haystack.Time:
+				value := formatTime(val)
+				values = append(values, &value)
+			default:
+				values = append(values, nil)
+			}
+		}
+		field = data.NewField(name, nil, values)
+	} else {
+		values := []*string{}
+		for _, val := range column.vals {
+			if exclusive && colTypeOf(val) != str {
+				values = append(values, nil)
+				continue
+			}
+			switch val := val.(type) {
+			case haystack.Str:
+				value := val.String()
+				values = append(values, &value)
+			case haystack.Time:
+				value := formatTime(val)
+				values = append(values, &value)
+			case haystack.Marker:
+				value := "✓"
+				values = append(values, &value)
+			case haystack.Symbol:
+				value := strings.TrimPrefix(val.ToZinc(), "^")
+				values = append(values, &value)
+			case haystack.Null:
+				values = append(values, nil)
+			default:
+				value := val.ToZinc()
+				values = append(values, &value)
 			}
 		}
+		field = data.NewField(name, nil, values)
+	}
 
-		var field *data.Field
-		if columnType == dateTime {
-			values := []*time.Time{}
-			for _, row := range grid.Rows() {
-				val := row.Get(col.Name())
-				switch val := val.(type) {
-				case haystack.DateTime:
-					value := val.ToGo()
-					values = append(values, &value)
-				case haystack.Date:
-					value := time.Date(val.Year(), time.Month(val.Month()), val.Day(), 0, 0, 0, 0, time.Local)
-					values = append(values, &value)
-				default:
-					values = append(values, nil)
-				}
+	// Set Grafana field info from Haystack grid info
+	config := &data.FieldConfig{}
+	config.DisplayName = disFromMeta(column.meta, column.name)
+	if name != column.name {
+		config.DisplayName += strings.TrimPrefix(name, column.name)
+	}
+	config.Unit = unitFromColumn(column)
+	config.Custom = customFromMeta(column.meta)
+	field.Config = config
+	return field
+}
+
+// column is a grid column that is being converted to fields
+type column struct {
+	name string
+	meta haystack.Dict
+	vals []haystack.Val
+	tzs  []string // The timezone of each row, used for dates. This is the row's `tz`, or the grid's.
+}
+
+// columnsFromGrid returns the columns of the grid
+func columnsFromGrid(grid haystack.Grid) []column {
+	tz := tzFromGrid(grid)
+	rows := grid.Rows()
+	tzs := make([]string, len(rows))
+	for i, row := range rows {
+		tzs[i] = tz
+		if rowTz, ok := row.Get("tz").(haystack.Str); ok {
+			tzs[i] = rowTz.String()
+		}
+	}
+
+	columns := []column{}
+	for _, col := range grid.Cols() {
+		vals := make([]haystack.Val, len(rows))
+		for i, row := range rows {
+			vals[i] = row.Get(col.Name())
+		}
+		columns = append(columns, column{name: col.Name(), meta: col.Meta(), vals: vals, tzs: tzs})
+	}
+	return columns
+}
+
+// customFromMeta returns the custom metadata of a frame or field, with the Haystack meta under `haystack` as Hayson.
+// It returns nil if the meta is empty.
+func customFromMeta(meta haystack.Dict) map[string]interface{} {
+	var decoded map[string]interface{}
+	hayson, err := json.Marshal(meta)
+	if err == nil {
+		err = json.Unmarshal(hayson, &decoded)
+	}
+	if err != nil {
+		log.DefaultLogger.Warn("Haystack meta could not be encoded", "error", err.Error())
+		return nil
+	}
+	if len(decoded) == 0 {
+		return nil
+	}
+	return map[string]interface{}{"haystack": decoded}
+}
+
+// The hisRead statuses of values that are replaced with null, if configured
+var badHisStatuses = []string{"fault", "stale"}
+
+// withHisStatus carries the statuses of hisRead values through to status fields. Some servers return the statuses
+// in a `status` column, and some return each value as a Dict with `val` and `status` tags. Dict values are replaced
+// with their `val`, and their statuses are added as a `status` column after the `val` column, or a `<column>_status`
+// column after other columns. If nullBadStatus is set, values with a fault or stale status are replaced with null.
+func withHisStatus(columns []column, nullBadStatus bool) []column {
+	var rowStatuses []haystack.Val
+	for _, column := range columns {
+		if column.name == "status" {
+			rowStatuses = column.vals
+		}
+	}
+
+	result := []column{}
+	for _, valColumn := range columns {
+		var statuses []haystack.Val
+		for i, val := range valColumn.vals {
+			dict, ok := val.(haystack.Dict)
+			if !ok || hisStatus(dict.Get("status")) == "" {
+				continue
 			}
-			field = data.NewField(col.Name(), nil, values)
-		} else if columnType == number {
-			values := []*float64{}
-			for _, row := range grid.Rows() {
-				val := row.Get(col.Name())
-				switch val := val.(type) {
-				case haystack.Number:
-					value := val.Float()
-					values = append(values, &value)
-				default:
-					values = append(values, nil)
+			if statuses == nil {
+				statuses = make([]haystack.Val, len(valColumn.vals))
+				for j := range statuses {
+					statuses[j] = haystack.NewNull()
 				}
 			}
-			field = data.NewField(col.Name(), nil, values)
-		} else if columnType == boolean {
-			values := []*bool{}
-			for _, row := range grid.Rows() {
-				val := row.Get(col.Name())
-				switch val := val.(type) {
-				case haystack.Bool:
-					value := val.ToBool()
-					values = append(values, &value)
-				default:
-					values = append(values, nil)
+			statuses[i] = dict.Get("status")
+			valColumn.vals[i] = dict.Get("val")
+		}
+
+		if nullBadStatus && valColumn.name != "ts" && valColumn.name != "status" {
+			for i := range valColumn.vals {
+				if (rowStatuses != nil && slices.Contains(badHisStatuses, hisStatus(rowStatuses[i]))) ||
+					(statuses != nil && slices.Contains(badHisStatuses, hisStatus(statuses[i]))) {
+					valColumn.vals[i] = haystack.NewNull()
 				}
 			}
-			field = data.NewField(col.Name(), nil, values)
-		} else {
-			values := []*string{}
-			for _, row := range grid.Rows() {
-				val := row.Get(col.Name())
-				switch val := val.(type) {
-				case haystack.Str:
-					value := val.String()
-					values = append(values, &value)
-				case haystack.Marker:
-					value := "✓"
-					values = append(values, &value)
-				case haystack.Null:
-					values = append(values, nil)
-				default:
-					value := val.ToZinc()
-					values = append(values, &value)
-				}
+		}
+
+		result = append(result, valColumn)
+		if statuses != nil {
+			name := valColumn.name + "_status"
+			if valColumn.name == "val" {
+				name = "status"
 			}
-			field = data.NewField(col.Name(), nil, values)
+			result = append(result, column{
+				name: name,
+				meta: haystack.NewDict(map[string]haystack.Val{}),
+				vals: statuses,
+				tzs:  valColumn.tzs,
+			})
 		}
+	}
+	return result
+}
 
-		// Set Grafana field info from Haystack grid info
-		config := &data.FieldConfig{}
-		config.DisplayName = disFromMeta(col.Meta(), col.Name())
-		config.Unit = unitFromGrid(grid, col)
-		field.Config = config
-		fields = append(fields, field)
+// hisStatus returns the status as a string, or an empty string if it isn't a Str or Symbol
+func hisStatus(status haystack.Val) string {
+	switch status := status.(type) {
+	case haystack.Str:
+		return status.String()
+	case haystack.Symbol:
+		return strings.TrimPrefix(status.ToZinc(), "^")
+	default:
+		return ""
 	}
+}
 
-	frame := data.NewFrame("response", fields...)
-	frameName := disFromMeta(grid.Meta(), "")
-	frame.Name = frameName
-	return frame
+// tzFromGrid returns the timezone of the grid, from its `tz` or `hisStart` meta. It defaults to UTC.
+func tzFromGrid(grid haystack.Grid) string {
+	switch meta := grid.Meta().Get("tz").(type) {
+	case haystack.Str:
+		return meta.String()
+	}
+	switch meta := grid.Meta().Get("hisStart").(type) {
+	case haystack.DateTime:
+		return meta.Tz()
+	}
+	return "UTC"
+}
+
+// startOfDate returns midnight at the start of the date in the Haystack timezone. Unknown timezones use UTC.
+func startOfDate(date haystack.Date, tz string) time.Time {
+	midnight := time.Date(date.Year(), time.Month(date.Month()), date.Day(), 0, 0, 0, 0, time.UTC)
+	// Look up the offset twice, in case it changes between midnight UTC and local midnight
+	start := midnight
+	for range 2 {
+		local, err := haystack.NewDateTimeFromGo(start).ToTz(tz)
+		if err != nil {
+			log.DefaultLogger.Debug("Unknown timezone, using UTC", "tz", tz, "error", err.Error())
+			return midnight
+		}
+		_, offset := local.ToGo().Zone()
+		start = midnight.Add(-time.Duration(offset) * time.Second)
+	}
+	return start
+}
+
+// formatTime formats the time of day as `hh:mm:ss`, with milliseconds if they are set
+func formatTime(val haystack.Time) string {
+	if val.Millisecond() != 0 {
+		return fmt.Sprintf("%02d:%02d:%02d.%03d", val.Hour(), val.Minute(), val.Second(), val.Millisecond())
+	}
+	return fmt.Sprintf("%02d:%02d:%02d", val.Hour(), val.Minute(), val.Second())
+}
+
+// shiftToWallClock replaces the times in the frame with UTC times that have the same wall-clock time as in
+// their original timezone. This lines up the histories of points in different timezones by local time of day.
+func shiftToWallClock(frame *data.Frame) {
+	for _, field := range frame.Fields {
+		if field.Type() != data.FieldTypeNullableTime {
+			continue
+		}
+		for i := 0; i < field.Len(); i++ {
+			value, ok := field.At(i).(*time.Time)
+			if !ok || value == nil {
+				continue
+			}
+			shifted := time.Date(value.Year(), value.Month(), value.Day(), value.Hour(), value.Minute(), value.Second(), value.Nanosecond(), time.UTC)
+			field.Set(i, &shifted)
+		}
+	}
 }
 
 // disFromMeta returns the display name using metadata. It falls back to the provided string if no other name can be found
@@ -535,21 +1283,18 @@ func disFromMeta(meta haystack.Dict, name string) string {
 	return name
 }
 
-// unitFromGrid returns the unit of a column in a haystack grid
-// It is expected that the column is from the grid
+// unitFromColumn returns the unit of a column
 // The unit is determined in the following order:
 // 1. If the column has a unit meta, return it
 // 2. If the column has a unit in the first row, return it
 // 3. Return empty string
-func unitFromGrid(grid haystack.Grid, col haystack.Col) string {
-	switch unit := col.Meta().Get("unit").(type) {
+func unitFromColumn(column column) string {
+	switch unit := column.meta.Get("unit").(type) {
 	case haystack.Str:
 		return unit.String()
 	default:
-		if grid.RowCount() >= 1 {
-			row := grid.RowAt(0)
-			val := row.Get(col.Name())
-			switch val := val.(type) {
+		if len(column.vals) >= 1 {
+			switch val := column.vals[0].(type) {
 			case haystack.Number:
 				return val.Unit()
 			}
@@ -567,5 +1312,74 @@ const (
 	number
 	str
 	boolean
+	timeOfDay
 	mixed
 )
+
+// The types of a mixed column, in order of preference when picking the dominant type
+var mixedColTypes = []colType{number, boolean, dateTime, timeOfDay, str}
+
+// colTypeOf returns the column type of a value, or none if it is null, NA, or Remove. NA and Remove don't affect
+// the column type, so that they become null in numeric and bool columns.
+func colTypeOf(val haystack.Val) colType {
+	switch val.(type) {
+	case haystack.Null, haystack.NA, haystack.Remove:
+		return none
+	case haystack.DateTime, haystack.Date:
+		return dateTime
+	case haystack.Number:
+		return number
+	case haystack.Bool:
+		return boolean
+	case haystack.Time:
+		return timeOfDay
+	default:
+		return str
+	}
+}
+
+// suffix returns the field name suffix of the type, used when a mixed column is split
+func (columnType colType) suffix() string {
+	switch columnType {
+	case dateTime:
+		return "date"
+	case number:
+		return "num"
+	case boolean:
+		return "bool"
+	case timeOfDay:
+		return "time"
+	default:
+		return "str"
+	}
+}
+
+// kind returns the Haystack kind of the type
+func (columnType colType) kind() string {
+	switch columnType {
+	case dateTime:
+		return "DateTime"
+	case number:
+		return "Number"
+	case boolean:
+		return "Bool"
+	case timeOfDay:
+		return "Time"
+	default:
+		return "Str"
+	}
+}
+
+// The ways of converting columns that mix value types. By default, every value is converted to a string.
+const (
+	mixedColumnsSplit    = "split"    // Split the column into a field for each type, like `curVal_num` and `curVal_str`
+	mixedColumnsDominant = "dominant" // Use the most common type, with a notice about the values of other types
+)
+
+// frameOptions configures the conversion of grids to frames
+type frameOptions struct {
+	mixedColumns     string // How columns that mix value types are converted
+	quality          bool   // Add a `<column>_quality` field after columns with NA or Remove values
+	hisStatus        bool   // Carry the statuses of hisRead values through to status fields
+	hisNullBadStatus bool   // Replace hisRead values with a fault or stale status with null
+}
@@ -2,13 +2,29 @@ package plugin
 
 import (
 	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
 	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"sync/atomic"
 	"testing"
 	"time"
 
 	"github.com/NeedleInAJayStack/haystack"
+	"github.com/NeedleInAJayStack/haystack-datasource/pkg/filter"
+	haystackClient "github.com/NeedleInAJayStack/haystack/client"
 	"github.com/google/go-cmp/cmp"
 	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/grafana/grafana-plugin-sdk-go/backend/httpclient"
 	"github.com/grafana/grafana-plugin-sdk-go/data"
 )
 
@@ -63,7 +79,14 @@ func TestQueryData_Eval_Dis(t *testing.T) {
 
 	aVal := "a"
 	expected := data.NewFrame("",
-		data.NewField("a", nil, []*string{&aVal}).SetConfig(&data.FieldConfig{DisplayName: "dis"}),
+		data.NewField("a", nil, []*string{&aVal}).SetConfig(&data.FieldConfig{
+			DisplayName: "dis",
+			Custom: map[string]interface{}{
+				"haystack": map[string]interface{}{
+					"id": map[string]interface{}{"_kind": "ref", "val": "abc", "dis": "dis"},
+				},
+			},
+		}),
 	)
 
 	if !cmp.Equal(actual, expected, data.FrameTestCompareOptions()...) {
@@ -71,6 +94,37 @@ func TestQueryData_Eval_Dis(t *testing.T) {
 	}
 }
 
+func TestDataFrameFromGrid_Meta(t *testing.T) {
+	grid := haystack.NewGridBuilder()
+	grid.AddMeta("hisStart", haystack.NewDateTimeFromGo(time.Unix(0, 0).UTC()))
+	grid.AddMeta("his", haystack.NewMarker())
+	grid.AddCol("ts", map[string]haystack.Val{})
+	grid.AddCol("v0", map[string]haystack.Val{"kind": haystack.NewStr("Number"), "unit": haystack.NewStr("kWh")})
+	grid.AddRow([]haystack.Val{haystack.NewDateTimeFromGo(time.Unix(0, 0)), haystack.NewNumber(5, "kWh")})
+
+	frame := dataFrameFromGrid(grid.ToGrid(), frameOptions{})
+
+	expectedFrame := map[string]interface{}{
+		"haystack": map[string]interface{}{
+			"hisStart": map[string]interface{}{"_kind": "dateTime", "val": "1970-01-01T00:00:00Z", "tz": "UTC"},
+			"his":      map[string]interface{}{"_kind": "marker"},
+		},
+	}
+	if !cmp.Equal(frame.Meta.Custom, expectedFrame) {
+		t.Error(cmp.Diff(frame.Meta.Custom, expectedFrame))
+	}
+	// Columns without meta have no custom config
+	if frame.Fields[0].Config.Custom != nil {
+		t.Errorf("Expected no custom config, got %v", frame.Fields[0].Config.Custom)
+	}
+	expectedField := map[string]interface{}{
+		"haystack": map[string]interface{}{"kind": "Number", "unit": "kWh"},
+	}
+	if !cmp.Equal(frame.Fields[1].Config.Custom, expectedField) {
+		t.Error(cmp.Diff(frame.Fields[1].Config.Custom, expectedField))
+	}
+}
+
 func TestQueryData_HisRead(t *testing.T) {
 	readByIdsResponse := haystack.NewGridBuilder()
 	readByIdsResponse.AddCol("id", map[string]haystack.Val{})
@@ -108,6 +162,295 @@ func TestQueryData_HisRead(t *testing.T) {
 	}
 }
 
+func TestQueryData_HisRead_LocalTime(t *testing.T) {
+	readByIdsResponse := haystack.NewGridBuilder()
+	readByIdsResponse.AddCol("id", map[string]haystack.Val{})
+	readByIdsResponse.AddCol("tz", map[string]haystack.Val{})
+	readByIdsResponse.AddRow([]haystack.Val{haystack.NewRef("abcdefg-12345678", ""), haystack.NewStr("New_York")})
+
+	// 9:00 in New York
+	ts, err := haystack.NewDateTimeFromGo(time.Date(2024, 1, 15, 14, 0, 0, 0, time.UTC)).ToTz("New_York")
+	if err != nil {
+		t.Fatal(err)
+	}
+	hisReadResponse := haystack.NewGridBuilder()
+	hisReadResponse.AddCol("ts", map[string]haystack.Val{})
+	hisReadResponse.AddCol("v0", map[string]haystack.Val{})
+	hisReadResponse.AddRow([]haystack.Val{ts, haystack.NewNumber(5, "kWh")})
+
+	client := &testHaystackClient{
+		readByIdsResponse: readByIdsResponse.ToGrid(),
+		hisReadResponse:   hisReadResponse.ToGrid(),
+	}
+
+	actual := getResponse(
+		client,
+		&QueryModel{
+			Type:         "hisRead",
+			HisRead:      "abcdefg-12345678",
+			HisLocalTime: true,
+		},
+		t,
+	)
+
+	tsVal := time.Date(2024, 1, 15, 9, 0, 0, 0, time.UTC)
+	v0Val := 5.0
+	expected := data.NewFrame("",
+		data.NewField("ts", nil, []*time.Time{&tsVal}).SetConfig(&data.FieldConfig{DisplayName: "ts"}),
+		data.NewField("v0", nil, []*float64{&v0Val}).SetConfig(&data.FieldConfig{DisplayName: "v0", Unit: "kWh"}),
+	)
+
+	if !cmp.Equal(actual, expected, data.FrameTestCompareOptions()...) {
+		t.Error(cmp.Diff(actual, expected, data.FrameTestCompareOptions()...))
+	}
+}
+
+func TestQueryData_HisRead_Status(t *testing.T) {
+	readByIdsResponse := haystack.NewGridBuilder()
+	readByIdsResponse.AddCol("id", map[string]haystack.Val{})
+	readByIdsResponse.AddCol("tz", map[string]haystack.Val{})
+	readByIdsResponse.AddRow([]haystack.Val{haystack.NewRef("abcdefg-12345678", ""), haystack.NewStr("UTC")})
+
+	hisReadResponse := haystack.NewGridBuilder()
+	hisReadResponse.AddCol("ts", map[string]haystack.Val{})
+	hisReadResponse.AddCol("val", map[string]haystack.Val{})
+	hisReadResponse.AddCol("status", map[string]haystack.Val{})
+	hisReadResponse.AddRow([]haystack.Val{haystack.NewDateTimeFromGo(time.Unix(0, 0)), haystack.NewNumber(1, "kWh"), haystack.NewStr("ok")})
+	hisReadResponse.AddRow([]haystack.Val{haystack.NewDateTimeFromGo(time.Unix(60, 0)), haystack.NewNumber(2, "kWh"), haystack.NewStr("fault")})
+	hisReadResponse.AddRow([]haystack.Val{haystack.NewDateTimeFromGo(time.Unix(120, 0)), haystack.NewNumber(3, "kWh"), haystack.NewStr("stale")})
+
+	client := &testHaystackClient{
+		readByIdsResponse: readByIdsResponse.ToGrid(),
+		hisReadResponse:   hisReadResponse.ToGrid(),
+	}
+
+	actual := getResponse(
+		client,
+		&QueryModel{
+			Type:             "hisRead",
+			HisRead:          "abcdefg-12345678",
+			HisNullBadStatus: true,
+		},
+		t,
+	)
+
+	expected := data.NewFrame("",
+		data.NewField("ts", nil, []*time.Time{ptr(time.Unix(0, 0)), ptr(time.Unix(60, 0)), ptr(time.Unix(120, 0))}).SetConfig(&data.FieldConfig{DisplayName: "ts"}),
+		data.NewField("val", nil, []*float64{ptr(1.0), nil, nil}).SetConfig(&data.FieldConfig{DisplayName: "", Unit: "kWh"}),
+		data.NewField("status", nil, []*string{ptr("ok"), ptr("fault"), ptr("stale")}).SetConfig(&data.FieldConfig{DisplayName: "status"}),
+	)
+
+	if !cmp.Equal(actual, expected, data.FrameTestCompareOptions()...) {
+		t.Error(cmp.Diff(actual, expected, data.FrameTestCompareOptions()...))
+	}
+}
+
+func TestDataFrameFromGrid_HisStatusDicts(t *testing.T) {
+	grid := haystack.NewGridBuilder()
+	grid.AddCol("ts", map[string]haystack.Val{})
+	grid.AddCol("val", map[string]haystack.Val{})
+	grid.AddRow([]haystack.Val{
+		haystack.NewDateTimeFromGo(time.Unix(0, 0)),
+		haystack.NewDict(map[string]haystack.Val{"val": haystack.NewNumber(1, "kWh"), "status": haystack.NewStr("ok")}),
+	})
+	grid.AddRow([]haystack.Val{
+		haystack.NewDateTimeFromGo(time.Unix(60, 0)),
+		haystack.NewDict(map[string]haystack.Val{"val": haystack.NewNumber(2, "kWh"), "status": haystack.NewStr("fault")}),
+	})
+	grid.AddRow([]haystack.Val{
+		haystack.NewDateTimeFromGo(time.Unix(120, 0)),
+		haystack.NewNumber(3, "kWh"),
+	})
+
+	ts := []*time.Time{ptr(time.Unix(0, 0)), ptr(time.Unix(60, 0)), ptr(time.Unix(120, 0))}
+	status := []*string{ptr("ok"), ptr("fault"), nil}
+
+	actual := dataFrameFromGrid(grid.ToGrid(), frameOptions{hisStatus: true})
+	expected := data.NewFrame("",
+		data.NewField("ts", nil, ts).SetConfig(&data.FieldConfig{DisplayName: "ts"}),
+		data.NewField("val", nil, []*float64{ptr(1.0), ptr(2.0), ptr(3.0)}).SetConfig(&data.FieldConfig{DisplayName: "val", Unit: "kWh"}),
+		data.NewField("status", nil, status).SetConfig(&data.FieldConfig{DisplayName: "status"}),
+	)
+	if !cmp.Equal(actual, expected, data.FrameTestCompareOptions()...) {
+		t.Error(cmp.Diff(actual, expected, data.FrameTestCompareOptions()...))
+	}
+
+	actual = dataFrameFromGrid(grid.ToGrid(), frameOptions{hisStatus: true, hisNullBadStatus: true})
+	expected = data.NewFrame("",
+		data.NewField("ts", nil, ts).SetConfig(&data.FieldConfig{DisplayName: "ts"}),
+		data.NewField("val", nil, []*float64{ptr(1.0), nil, ptr(3.0)}).SetConfig(&data.FieldConfig{DisplayName: "val", Unit: "kWh"}),
+		data.NewField("status", nil, status).SetConfig(&data.FieldConfig{DisplayName: "status"}),
+	)
+	if !cmp.Equal(actual, expected, data.FrameTestCompareOptions()...) {
+		t.Error(cmp.Diff(actual, expected, data.FrameTestCompareOptions()...))
+	}
+}
+
+func TestDataFrameFromGrid_DateTz(t *testing.T) {
+	grid := haystack.NewGridBuilder()
+	grid.AddMeta("tz", haystack.NewStr("New_York"))
+	grid.AddCol("date", map[string]haystack.Val{})
+	grid.AddCol("tz", map[string]haystack.Val{})
+	grid.AddCol("time", map[string]haystack.Val{})
+	grid.AddRow([]haystack.Val{haystack.NewDate(2024, 1, 15), haystack.NewNull(), haystack.NewTime(9, 30, 0, 0)})
+	grid.AddRow([]haystack.Val{haystack.NewDate(2024, 7, 15), haystack.NewNull(), haystack.NewTime(17, 0, 0, 250)})
+	grid.AddRow([]haystack.Val{haystack.NewDate(2024, 7, 15), haystack.NewStr("Tokyo"), haystack.NewNull()})
+
+	actual := dataFrameFromGrid(grid.ToGrid(), frameOptions{})
+
+	// Dates start at midnight in the record's timezone, or the grid's
+	winter := time.Date(2024, 1, 15, 5, 0, 0, 0, time.UTC)
+	summer := time.Date(2024, 7, 15, 4, 0, 0, 0, time.UTC)
+	tokyo := time.Date(2024, 7, 14, 15, 0, 0, 0, time.UTC)
+	tokyoTz := "Tokyo"
+	morning := "09:30:00"
+	evening := "17:00:00.250"
+	expected := data.NewFrame("",
+		data.NewField("date", nil, []*time.Time{&winter, &summer, &tokyo}).SetConfig(&data.FieldConfig{DisplayName: "date"}),
+		data.NewField("tz", nil, []*string{nil, nil, &tokyoTz}).SetConfig(&data.FieldConfig{DisplayName: "tz"}),
+		data.NewField("time", nil, []*string{&morning, &evening, nil}).SetConfig(&data.FieldConfig{DisplayName: "time"}),
+	)
+	expected.Meta = &data.FrameMeta{Custom: map[string]interface{}{
+		"haystack": map[string]interface{}{"tz": "New_York"},
+	}}
+
+	if !cmp.Equal(actual, expected, data.FrameTestCompareOptions()...) {
+		t.Error(cmp.Diff(actual, expected, data.FrameTestCompareOptions()...))
+	}
+}
+
+func TestDataFrameFromGrid_MixedColumns(t *testing.T) {
+	grid := haystack.NewGridBuilder()
+	grid.AddCol("curVal", map[string]haystack.Val{})
+	grid.AddRow([]haystack.Val{haystack.NewNumber(1, "kWh")})
+	grid.AddRow([]haystack.Val{haystack.NewStr("on")})
+	grid.AddRow([]haystack.Val{haystack.NewNumber(2, "kWh")})
+	grid.AddRow([]haystack.Val{haystack.NewBool(true)})
+	grid.AddRow([]haystack.Val{haystack.NewNull()})
+
+	one := 1.0
+	two := 2.0
+	on := "on"
+	yes := true
+
+	t.Run("split", func(t *testing.T) {
+		actual := dataFrameFromGrid(grid.ToGrid(), frameOptions{mixedColumns: mixedColumnsSplit})
+		expected := data.NewFrame("",
+			data.NewField("curVal_num", nil, []*float64{&one, nil, &two, nil, nil}).SetConfig(&data.FieldConfig{DisplayName: "curVal_num", Unit: "kWh"}),
+			data.NewField("curVal_bool", nil, []*bool{nil, nil, nil, &yes, nil}).SetConfig(&data.FieldConfig{DisplayName: "curVal_bool"}),
+			data.NewField("curVal_str", nil, []*string{nil, &on, nil, nil, nil}).SetConfig(&data.FieldConfig{DisplayName: "curVal_str"}),
+		)
+		if !cmp.Equal(actual, expected, data.FrameTestCompareOptions()...) {
+			t.Error(cmp.Diff(actual, expected, data.FrameTestCompareOptions()...))
+		}
+	})
+
+	t.Run("dominant", func(t *testing.T) {
+		actual := dataFrameFromGrid(grid.ToGrid(), frameOptions{mixedColumns: mixedColumnsDominant})
+		expected := data.NewFrame("",
+			data.NewField("curVal", nil, []*float64{&one, nil, &two, nil, nil}).SetConfig(&data.FieldConfig{DisplayName: "curVal", Unit: "kWh"}),
+		)
+		expected.AppendNotices(data.Notice{
+			Severity: data.NoticeSeverityWarning,
+			Text:     "Column curVal has mixed types: 2 values that aren't Number were replaced with null",
+		})
+		if !cmp.Equal(actual, expected, data.FrameTestCompareOptions()...) {
+			t.Error(cmp.Diff(actual, expected, data.FrameTestCompareOptions()...))
+		}
+	})
+
+	t.Run("string", func(t *testing.T) {
+		actual := dataFrameFromGrid(grid.ToGrid(), frameOptions{})
+		if actual.Fields[0].Type() != data.FieldTypeNullableString {
+			t.Errorf("Expected a string field, got %v", actual.Fields[0].Type())
+		}
+	})
+}
+
+func TestDataFrameFromGrid_Kinds(t *testing.T) {
+	dateTime := time.Date(2024, 1, 15, 9, 30, 0, 0, time.UTC)
+	uri := haystack.NewUri("http://example.com")
+	xstr := haystack.NewXStr("Span", "today")
+	ref := haystack.NewRef("abc", "Site")
+	coord := haystack.NewCoord(37.5, -77.5)
+	list := haystack.NewList([]haystack.Val{haystack.NewStr("a")})
+	dict := haystack.NewDict(map[string]haystack.Val{"a": haystack.NewMarker()})
+
+	tests := map[string]struct {
+		val      haystack.Val
+		expected interface{}
+	}{
+		"null":     {haystack.NewNull(), []*string{nil}},
+		"marker":   {haystack.NewMarker(), []*string{ptr("✓")}},
+		"na":       {haystack.NewNA(), []*string{ptr(haystack.NewNA().ToZinc())}},
+		"remove":   {haystack.NewRemove(), []*string{ptr(haystack.NewRemove().ToZinc())}},
+		"bool":     {haystack.NewBool(true), []*bool{ptr(true)}},
+		"number":   {haystack.NewNumber(5, "kWh"), []*float64{ptr(5.0)}},
+		"str":      {haystack.NewStr("a"), []*string{ptr("a")}},
+		"uri":      {uri, []*string{ptr(uri.ToZinc())}},
+		"ref":      {ref, []*string{ptr(ref.ToZinc())}},
+		"symbol":   {haystack.NewSymbol("elec-meter"), []*string{ptr("elec-meter")}},
+		"date":     {haystack.NewDate(2024, 1, 15), []*time.Time{ptr(time.Date(2024, 1, 15, 0, 0, 0, 0, time.UTC))}},
+		"time":     {haystack.NewTime(9, 30, 0, 0), []*string{ptr("09:30:00")}},
+		"dateTime": {haystack.NewDateTimeFromGo(dateTime), []*time.Time{ptr(dateTime)}},
+		"coord":    {coord, []*string{ptr(coord.ToZinc())}},
+		"xstr":     {xstr, []*string{ptr(xstr.ToZinc())}},
+		"list":     {list, []*string{ptr(list.ToZinc())}},
+		"dict":     {dict, []*string{ptr(dict.ToZinc())}},
+	}
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			grid := haystack.NewGridBuilder()
+			grid.AddCol("a", map[string]haystack.Val{})
+			grid.AddRow([]haystack.Val{test.val})
+
+			actual := dataFrameFromGrid(grid.ToGrid(), frameOptions{})
+			config := &data.FieldConfig{DisplayName: "a"}
+			if name == "number" {
+				config.Unit = "kWh"
+			}
+			expected := data.NewFrame("", data.NewField("a", nil, test.expected).SetConfig(config))
+			if !cmp.Equal(actual, expected, data.FrameTestCompareOptions()...) {
+				t.Error(cmp.Diff(actual, expected, data.FrameTestCompareOptions()...))
+			}
+		})
+	}
+}
+
+func TestDataFrameFromGrid_Quality(t *testing.T) {
+	grid := haystack.NewGridBuilder()
+	grid.AddCol("val", map[string]haystack.Val{})
+	grid.AddCol("enabled", map[string]haystack.Val{})
+	grid.AddRow([]haystack.Val{haystack.NewNumber(1, ""), haystack.NewBool(true)})
+	grid.AddRow([]haystack.Val{haystack.NewNA(), haystack.NewRemove()})
+	grid.AddRow([]haystack.Val{haystack.NewRemove(), haystack.NewBool(false)})
+	grid.AddRow([]haystack.Val{haystack.NewNull(), haystack.NewNull()})
+
+	// NA and Remove don't make the columns mixed
+	vals := []*float64{ptr(1.0), nil, nil, nil}
+	enabled := []*bool{ptr(true), nil, ptr(false), nil}
+
+	actual := dataFrameFromGrid(grid.ToGrid(), frameOptions{})
+	expected := data.NewFrame("",
+		data.NewField("val", nil, vals).SetConfig(&data.FieldConfig{DisplayName: "val"}),
+		data.NewField("enabled", nil, enabled).SetConfig(&data.FieldConfig{DisplayName: "enabled"}),
+	)
+	if !cmp.Equal(actual, expected, data.FrameTestCompareOptions()...) {
+		t.Error(cmp.Diff(actual, expected, data.FrameTestCompareOptions()...))
+	}
+
+	actual = dataFrameFromGrid(grid.ToGrid(), frameOptions{quality: true})
+	expected = data.NewFrame("",
+		data.NewField("val", nil, vals).SetConfig(&data.FieldConfig{DisplayName: "val"}),
+		data.NewField("val_quality", nil, []*string{ptr("ok"), ptr("na"), ptr("remove"), nil}).SetConfig(&data.FieldConfig{DisplayName: "val_quality"}),
+		data.NewField("enabled", nil, enabled).SetConfig(&data.FieldConfig{DisplayName: "enabled"}),
+		data.NewField("enabled_quality", nil, []*string{ptr("ok"), ptr("remove"), ptr("ok"), nil}).SetConfig(&data.FieldConfig{DisplayName: "enabled_quality"}),
+	)
+	if !cmp.Equal(actual, expected, data.FrameTestCompareOptions()...) {
+		t.Error(cmp.Diff(actual, expected, data.FrameTestCompareOptions()...))
+	}
+}
+
 func TestQueryData_Read(t *testing.T) {
 	response := haystack.NewGridBuilder()
 	response.AddCol("id", map[string]haystack.Val{})
@@ -197,10 +540,864 @@ func TestQueryData_Nav(t *testing.T) {
 	}
 }
 
+func TestQueryData_Annotations(t *testing.T) {
+	response := haystack.NewGridBuilder()
+	response.AddCol("id", map[string]haystack.Val{})
+	response.AddCol("dis", map[string]haystack.Val{})
+	response.AddCol("ts", map[string]haystack.Val{})
+	response.AddCol("clearTime", map[string]haystack.Val{})
+	response.AddCol("alarm", map[string]haystack.Val{})
+	response.AddCol("fault", map[string]haystack.Val{})
+	response.AddRow([]haystack.Val{
+		haystack.NewRef("alarm-2", "Alarm 2"),
+		haystack.NewStr("Low Temp"),
+		haystack.NewDateTimeFromGo(time.Unix(200, 0)),
+		haystack.NewNull(),
+		haystack.NewMarker(),
+		haystack.NewNull(),
+	})
+	response.AddRow([]haystack.Val{
+		haystack.NewRef("alarm-1", "Alarm 1"),
+		haystack.NewStr("High Temp"),
+		haystack.NewDateTimeFromGo(time.Unix(100, 0)),
+		haystack.NewDateTimeFromGo(time.Unix(150, 0)),
+		haystack.NewMarker(),
+		haystack.NewMarker(),
+	})
+	response.AddRow([]haystack.Val{
+		haystack.NewRef("alarm-0", "Alarm 0"),
+		haystack.NewStr("Out of range"),
+		haystack.NewDateTimeFromGo(time.Unix(10, 0)),
+		haystack.NewDateTimeFromGo(time.Unix(20, 0)),
+		haystack.NewMarker(),
+		haystack.NewNull(),
+	})
+
+	client := &testHaystackClient{
+		readResponse: response.ToGrid(),
+	}
+
+	actual := getResponseInRange(
+		client,
+		&QueryModel{
+			Type:        "annotations",
+			Annotations: "alarm",
+		},
+		backend.TimeRange{From: time.Unix(50, 0), To: time.Unix(300, 0)},
+		t,
+	)
+
+	end := time.Unix(150, 0)
+	expected := data.NewFrame("annotations",
+		data.NewField("time", nil, []time.Time{time.Unix(100, 0), time.Unix(200, 0)}),
+		data.NewField("timeEnd", nil, []*time.Time{&end, nil}),
+		data.NewField("title", nil, []string{"High Temp", "Low Temp"}),
+		data.NewField("text", nil, []string{"", ""}),
+		data.NewField("tags", nil, []string{"alarm,fault", "alarm"}),
+	)
+
+	if !cmp.Equal(actual, expected, data.FrameTestCompareOptions()...) {
+		t.Error(cmp.Diff(actual, expected, data.FrameTestCompareOptions()...))
+	}
+}
+
+func TestQueryData_AnnotationsSources(t *testing.T) {
+	timeRange := backend.TimeRange{From: time.Unix(50, 0), To: time.Unix(300, 0)}
+	start := haystack.NewDateTimeFromGo(timeRange.From.UTC()).ToAxon()
+	end := haystack.NewDateTimeFromGo(timeRange.To.UTC()).ToAxon()
+
+	tests := map[string]struct {
+		annotations string
+		expected    string
+	}{
+		"eval": {
+			"readAll(alarm and ts >= $__timeRange_start)",
+			"readAll(alarm and ts >= " + start + ")",
+		},
+		"sparks": {
+			"ahu",
+			"ruleSparks(readAll(ahu), (" + start + ").date..(" + end + ").date)",
+		},
+	}
+	for source, test := range tests {
+		exprs := []string{}
+		client := &testHaystackClient{
+			evalFunc: func(expr string) (haystack.Grid, error) {
+				exprs = append(exprs, expr)
+				return haystack.EmptyGrid(), nil
+			},
+		}
+		getResponseInRange(
+			client,
+			&QueryModel{Type: "annotations", AnnotationsSource: source, Annotations: test.annotations},
+			timeRange,
+			t,
+		)
+		if !cmp.Equal(exprs, []string{test.expected}) {
+			t.Errorf("%s: %s", source, cmp.Diff(exprs, []string{test.expected}))
+		}
+	}
+}
+
+func TestQueryData_Sites(t *testing.T) {
+	sites := haystack.NewGridBuilder()
+	sites.AddCol("id", map[string]haystack.Val{})
+	sites.AddCol("dis", map[string]haystack.Val{})
+	sites.AddCol("geoCoord", map[string]haystack.Val{})
+	sites.AddCol("geoAddr", map[string]haystack.Val{})
+	sites.AddCol("geoCity", map[string]haystack.Val{})
+	sites.AddCol("area", map[string]haystack.Val{})
+	sites.AddRow([]haystack.Val{
+		haystack.NewRef("site-1", "Site 1"),
+		haystack.NewStr("Site 1"),
+		haystack.NewCoord(37.5, -77.25),
+		haystack.NewStr("1 Main St"),
+		haystack.NewStr("Richmond"),
+		haystack.NewNumber(1000, "ft²"),
+	})
+	sites.AddRow([]haystack.Val{
+		haystack.NewRef("site-2", "Site 2"),
+		haystack.NewStr("Site 2"),
+		haystack.NewNull(),
+		haystack.NewNull(),
+		haystack.NewNull(),
+		haystack.NewNull(),
+	})
+
+	status := haystack.NewGridBuilder()
+	status.AddCol("id", map[string]haystack.Val{})
+	status.AddCol("siteRef", map[string]haystack.Val{})
+	status.AddRow([]haystack.Val{haystack.NewRef("alarm-1", ""), haystack.NewRef("site-1", "")})
+	status.AddRow([]haystack.Val{haystack.NewRef("alarm-2", ""), haystack.NewRef("site-1", "")})
+
+	client := &testHaystackClient{
+		readResponses: map[string]haystack.Grid{
+			"site":             sites.ToGrid(),
+			"alarm and active": status.ToGrid(),
+		},
+	}
+
+	actual := getResponse(
+		client,
+		&QueryModel{
+			Type:        "sites",
+			SitesStatus: "alarm and active",
+		},
+		t,
+	)
+
+	id1 := "@site-1 \"Site 1\""
+	id2 := "@site-2 \"Site 2\""
+	dis1 := "Site 1"
+	dis2 := "Site 2"
+	lat := 37.5
+	lng := -77.25
+	addr := "1 Main St"
+	city := "Richmond"
+	area := 1000.0
+	status1 := 2.0
+	status2 := 0.0
+	expected := data.NewFrame("sites",
+		data.NewField("id", nil, []*string{&id1, &id2}),
+		data.NewField("dis", nil, []*string{&dis1, &dis2}),
+		data.NewField("latitude", nil, []*float64{&lat, nil}),
+		data.NewField("longitude", nil, []*float64{&lng, nil}),
+		data.NewField("geoAddr", nil, []*string{&addr, nil}),
+		data.NewField("geoCity", nil, []*string{&city, nil}),
+		data.NewField("area", nil, []*float64{&area, nil}).SetConfig(&data.FieldConfig{Unit: "ft²"}),
+		data.NewField("status", nil, []*float64{&status1, &status2}),
+	)
+
+	if !cmp.Equal(actual, expected, data.FrameTestCompareOptions()...) {
+		t.Error(cmp.Diff(actual, expected, data.FrameTestCompareOptions()...))
+	}
+}
+
+// treeRecords returns a fixture of site, equip, and point records
+func treeRecords() haystack.Grid {
+	response := haystack.NewGridBuilder()
+	response.AddCol("id", map[string]haystack.Val{})
+	response.AddCol("dis", map[string]haystack.Val{})
+	response.AddCol("site", map[string]haystack.Val{})
+	response.AddCol("equip", map[string]haystack.Val{})
+	response.AddCol("point", map[string]haystack.Val{})
+	response.AddCol("siteRef", map[string]haystack.Val{})
+	response.AddCol("equipRef", map[string]haystack.Val{})
+	response.AddRow([]haystack.Val{
+		haystack.NewRef("point-1", ""),
+		haystack.NewStr("Temp"),
+		haystack.NewNull(),
+		haystack.NewNull(),
+		haystack.NewMarker(),
+		haystack.NewRef("site-1", ""),
+		haystack.NewRef("equip-1", ""),
+	})
+	response.AddRow([]haystack.Val{
+		haystack.NewRef("equip-1", ""),
+		haystack.NewStr("AHU-1"),
+		haystack.NewNull(),
+		haystack.NewMarker(),
+		haystack.NewNull(),
+		haystack.NewRef("site-1", ""),
+		haystack.NewNull(),
+	})
+	response.AddRow([]haystack.Val{
+		haystack.NewRef("site-1", ""),
+		haystack.NewStr("Site 1"),
+		haystack.NewMarker(),
+		haystack.NewNull(),
+		haystack.NewNull(),
+		haystack.NewNull(),
+		haystack.NewNull(),
+	})
+	response.AddRow([]haystack.Val{
+		haystack.NewRef("site-2", ""),
+		haystack.NewStr("Site 2"),
+		haystack.NewMarker(),
+		haystack.NewNull(),
+		haystack.NewNull(),
+		haystack.NewNull(),
+		haystack.NewNull(),
+	})
+	return response.ToGrid()
+}
+
+func TestQueryData_Tree(t *testing.T) {
+	records := treeRecords()
+	client := &testHaystackClient{
+		readRecords: &records,
+	}
+
+	actual := getResponse(
+		client,
+		&QueryModel{
+			Type: "tree",
+			Tree: "@site-1 \"Site 1\"",
+		},
+		t,
+	)
+
+	site1 := "@site-1"
+	equip1 := "@equip-1"
+	expected := data.NewFrame("tree",
+		data.NewField("path", nil, []string{"/Site 1", "/Site 1/AHU-1", "/Site 1/AHU-1/Temp"}),
+		data.NewField("parentId", nil, []*string{nil, &site1, &equip1}),
+		data.NewField("depth", nil, []int64{0, 1, 2}),
+		data.NewField("id", nil, []string{"@site-1", "@equip-1", "@point-1"}),
+		data.NewField("dis", nil, []string{"Site 1", "AHU-1", "Temp"}),
+		data.NewField("kind", nil, []string{"site", "equip", "point"}),
+	)
+
+	if !cmp.Equal(actual, expected, data.FrameTestCompareOptions()...) {
+		t.Error(cmp.Diff(actual, expected, data.FrameTestCompareOptions()...))
+	}
+}
+
+func TestTreeNodes_Refresh(t *testing.T) {
+	mod := time.Date(2024, 5, 1, 12, 30, 0, 0, time.UTC)
+	sites := func(dis string) haystack.Grid {
+		grid := haystack.NewGridBuilder()
+		grid.AddCol("id", map[string]haystack.Val{})
+		grid.AddCol("dis", map[string]haystack.Val{})
+		grid.AddCol("site", map[string]haystack.Val{})
+		grid.AddCol("mod", map[string]haystack.Val{})
+		grid.AddRow([]haystack.Val{haystack.NewRef("site-1", ""), haystack.NewStr(dis), haystack.NewMarker(), haystack.NewDateTimeFromGo(mod)})
+		return grid.ToGrid()
+	}
+	opsResponse := func(ops ...string) *haystack.Grid {
+		grid := haystack.NewGridBuilder()
+		grid.AddCol("def", map[string]haystack.Val{})
+		for _, op := range ops {
+			grid.AddRow([]haystack.Val{haystack.NewSymbol("op:" + op)})
+		}
+		result := grid.ToGrid()
+		return &result
+	}
+
+	for name, test := range map[string]struct {
+		ops           []string
+		expectedExprs []string
+		expectedDis   string
+	}{
+		"eval": {
+			ops:           []string{"read", "eval"},
+			expectedExprs: []string{"readAll((site or space or equip or point) and mod >= " + haystack.NewDateTimeFromGo(mod).ToAxon() + ")"},
+			expectedDis:   "Site 1 renamed",
+		},
+		"no eval": {
+			ops:         []string{"read"},
+			expectedDis: "Site 1",
+		},
+	} {
+		exprs := []string{}
+		client := &testHaystackClient{
+			readResponse: sites("Site 1"),
+			opsResponse:  opsResponse(test.ops...),
+			evalFunc: func(expr string) (haystack.Grid, error) {
+				exprs = append(exprs, expr)
+				return sites("Site 1 renamed"), nil
+			},
+		}
+		ds := Datasource{client: client}
+
+		_, err := ds.treeNodes(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		ds.treeCache.refreshedAt = time.Now().Add(-2 * treeRefreshInterval)
+		nodes, err := ds.treeNodes(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !slices.Equal(exprs, test.expectedExprs) {
+			t.Errorf("%s: expected %v, got %v", name, test.expectedExprs, exprs)
+		}
+		if nodes["site-1"].dis != test.expectedDis {
+			t.Errorf("%s: expected %s, got %s", name, test.expectedDis, nodes["site-1"].dis)
+		}
+	}
+}
+
+func TestQueryData_Tree_Filter(t *testing.T) {
+	records := treeRecords()
+	client := &testHaystackClient{
+		readRecords: &records,
+	}
+
+	// Selects the points of Site 1, along with their ancestors
+	actual := getResponse(
+		client,
+		&QueryModel{
+			Type:       "tree",
+			TreeFilter: "point and equipRef->siteRef->dis == \"Site 1\"",
+		},
+		t,
+	)
+
+	site1 := "@site-1"
+	equip1 := "@equip-1"
+	expected := data.NewFrame("tree",
+		data.NewField("path", nil, []string{"/Site 1", "/Site 1/AHU-1", "/Site 1/AHU-1/Temp"}),
+		data.NewField("parentId", nil, []*string{nil, &site1, &equip1}),
+		data.NewField("depth", nil, []int64{0, 1, 2}),
+		data.NewField("id", nil, []string{"@site-1", "@equip-1", "@point-1"}),
+		data.NewField("dis", nil, []string{"Site 1", "AHU-1", "Temp"}),
+		data.NewField("kind", nil, []string{"site", "equip", "point"}),
+	)
+
+	if !cmp.Equal(actual, expected, data.FrameTestCompareOptions()...) {
+		t.Error(cmp.Diff(actual, expected, data.FrameTestCompareOptions()...))
+	}
+}
+
+func TestQueryData_Read_Records(t *testing.T) {
+	records := treeRecords()
+	client := &testHaystackClient{
+		readRecords: &records,
+	}
+
+	actual := getResponse(
+		client,
+		&QueryModel{
+			Type: "read",
+			Read: "equip and siteRef->dis == \"Site 1\"",
+		},
+		t,
+	)
+
+	id := "@equip-1"
+	dis := "AHU-1"
+	equip := "✓"
+	siteRef := "@site-1"
+	expected := data.NewFrame("",
+		data.NewField("id", nil, []*string{&id}).SetConfig(&data.FieldConfig{DisplayName: "id"}),
+		data.NewField("dis", nil, []*string{&dis}).SetConfig(&data.FieldConfig{DisplayName: "dis"}),
+		data.NewField("site", nil, []*string{nil}).SetConfig(&data.FieldConfig{DisplayName: "site"}),
+		data.NewField("equip", nil, []*string{&equip}).SetConfig(&data.FieldConfig{DisplayName: "equip"}),
+		data.NewField("point", nil, []*string{nil}).SetConfig(&data.FieldConfig{DisplayName: "point"}),
+		data.NewField("siteRef", nil, []*string{&siteRef}).SetConfig(&data.FieldConfig{DisplayName: "siteRef"}),
+		data.NewField("equipRef", nil, []*string{nil}).SetConfig(&data.FieldConfig{DisplayName: "equipRef"}),
+	)
+
+	if !cmp.Equal(actual, expected, data.FrameTestCompareOptions()...) {
+		t.Error(cmp.Diff(actual, expected, data.FrameTestCompareOptions()...))
+	}
+}
+
+func TestQueryData_HisReadFilter_Or(t *testing.T) {
+	points := haystack.NewGridBuilder()
+	points.AddCol("id", map[string]haystack.Val{})
+	points.AddCol("tz", map[string]haystack.Val{})
+	points.AddRow([]haystack.Val{haystack.NewRef("abcdefg-12345678", ""), haystack.NewStr("UTC")})
+
+	hisReadResponse := haystack.NewGridBuilder()
+	hisReadResponse.AddCol("ts", map[string]haystack.Val{})
+	hisReadResponse.AddCol("val", map[string]haystack.Val{})
+	hisReadResponse.AddRow([]haystack.Val{haystack.NewDateTimeFromGo(time.Unix(0, 0)), haystack.NewNumber(5, "kWh")})
+
+	// The `his` clause must apply to both sides of the `or`
+	client := &testHaystackClient{
+		readResponses: map[string]haystack.Grid{
+			"(temp or humidity) and his": points.ToGrid(),
+		},
+		hisReadResponse: hisReadResponse.ToGrid(),
+	}
+
+	actual := getResponse(
+		client,
+		&QueryModel{
+			Type:          "hisReadFilter",
+			HisReadFilter: "temp or humidity",
+		},
+		t,
+	)
+
+	tsVal := time.Unix(0, 0)
+	valVal := 5.0
+	expected := data.NewFrame("",
+		data.NewField("ts", nil, []*time.Time{&tsVal}).SetConfig(&data.FieldConfig{DisplayName: "ts"}),
+		data.NewField("val", nil, []*float64{&valVal}).SetConfig(&data.FieldConfig{DisplayName: "", Unit: "kWh"}),
+	)
+
+	if !cmp.Equal(actual, expected, data.FrameTestCompareOptions()...) {
+		t.Error(cmp.Diff(actual, expected, data.FrameTestCompareOptions()...))
+	}
+}
+
+func TestQueryData_HisReadFilter_Concurrency(t *testing.T) {
+	points := haystack.NewGridBuilder()
+	points.AddCol("id", map[string]haystack.Val{})
+	points.AddCol("tz", map[string]haystack.Val{})
+	for i := range 3 * hisReadFilterConcurrency {
+		points.AddRow([]haystack.Val{haystack.NewRef(fmt.Sprintf("p%d", i), ""), haystack.NewStr("UTC")})
+	}
+
+	var reading, maxReading, reads atomic.Int32
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	client := &testHaystackClient{
+		readResponse: points.ToGrid(),
+		hisReadFunc: func(ref haystack.Ref) (haystack.Grid, error) {
+			reads.Add(1)
+			current := reading.Add(1)
+			defer reading.Add(-1)
+			for {
+				seen := maxReading.Load()
+				if current <= seen || maxReading.CompareAndSwap(seen, current) {
+					break
+				}
+			}
+			time.Sleep(20 * time.Millisecond)
+			// The query is cancelled while the first points are being read
+			cancel()
+			return haystack.EmptyGrid(), nil
+		},
+	}
+	ds := Datasource{client: client}
+
+	rawJson, err := json.Marshal(&QueryModel{Type: "hisReadFilter", HisReadFilter: "point"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = ds.QueryData(ctx, &backend.QueryDataRequest{Queries: []backend.DataQuery{{RefID: "A", JSON: rawJson}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Wait for the reads in progress to finish
+	time.Sleep(100 * time.Millisecond)
+	if maxReading.Load() > hisReadFilterConcurrency {
+		t.Errorf("Expected at most %d concurrent reads, got %d", hisReadFilterConcurrency, maxReading.Load())
+	}
+	if reads.Load() > hisReadFilterConcurrency {
+		t.Errorf("Expected no reads after cancellation, got %d reads", reads.Load())
+	}
+}
+
+func TestQueryData_Read_InvalidFilter(t *testing.T) {
+	client := &testHaystackClient{}
+	ds := Datasource{client: client}
+
+	rawJson, err := json.Marshal(&QueryModel{Type: "read", Read: "equip and"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := ds.QueryData(
+		context.Background(),
+		&backend.QueryDataRequest{
+			Queries: []backend.DataQuery{{RefID: "A", JSON: rawJson}},
+		},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	queryResponse := resp.Responses["A"]
+	if queryResponse.Status != backend.StatusBadRequest {
+		t.Fatalf("Expected bad request status, got '%v'", queryResponse.Status)
+	}
+	expected := "Read failure: invalid filter at position 9: unexpected end of filter"
+	if queryResponse.Error.Error() != expected {
+		t.Errorf("Expected error %q, got %q", expected, queryResponse.Error.Error())
+	}
+}
+
+func TestQueryData_Concurrent(t *testing.T) {
+	grid := func(val string) haystack.Grid {
+		response := haystack.NewGridBuilder()
+		response.AddCol("a", map[string]haystack.Val{})
+		response.AddRow([]haystack.Val{haystack.NewStr(val)})
+		return response.ToGrid()
+	}
+
+	// "first" can't finish until "second" has, which deadlocks if the queries run in order
+	secondDone := make(chan struct{})
+	client := &testHaystackClient{
+		evalFunc: func(expr string) (haystack.Grid, error) {
+			switch expr {
+			case "first":
+				select {
+				case <-secondDone:
+				case <-time.After(5 * time.Second):
+					return haystack.EmptyGrid(), fmt.Errorf("queries did not run concurrently")
+				}
+				return grid("first"), nil
+			case "second":
+				close(secondDone)
+				return grid("second"), nil
+			case "fail":
+				return haystack.EmptyGrid(), fmt.Errorf("eval failed")
+			default:
+				panic("unexpected expr " + expr)
+			}
+		},
+	}
+	ds := Datasource{client: client}
+
+	queries := []backend.DataQuery{}
+	for refID, expr := range map[string]string{"A": "first", "B": "second", "C": "fail", "D": "panic"} {
+		rawJson, err := json.Marshal(QueryModel{Type: "eval", Eval: expr})
+		if err != nil {
+			t.Fatal(err)
+		}
+		queries = append(queries, backend.DataQuery{RefID: refID, JSON: rawJson})
+	}
+	resp, err := ds.QueryData(context.Background(), &backend.QueryDataRequest{Queries: queries})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for refID, expected := range map[string]string{"A": "first", "B": "second"} {
+		response := resp.Responses[refID]
+		if response.Error != nil {
+			t.Fatalf("%s: %v", refID, response.Error)
+		}
+		actual := response.Frames[0].Fields[0].At(0).(*string)
+		if *actual != expected {
+			t.Errorf("%s: expected %s, got %s", refID, expected, *actual)
+		}
+	}
+	if resp.Responses["C"].Error == nil || resp.Responses["C"].Error.Error() != "Eval failure: eval failed" {
+		t.Errorf("C: expected an eval failure, got %v", resp.Responses["C"].Error)
+	}
+	if resp.Responses["D"].Error == nil || resp.Responses["D"].Error.Error() != "Query failure: unexpected expr panic" {
+		t.Errorf("D: expected a query failure, got %v", resp.Responses["D"].Error)
+	}
+}
+
+func TestQueryData_Cancelled(t *testing.T) {
+	client := &testHaystackClient{
+		evalFunc: func(expr string) (haystack.Grid, error) {
+			t.Error("Expected no queries to run")
+			return haystack.EmptyGrid(), nil
+		},
+	}
+	ds := Datasource{client: client}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	rawJson, err := json.Marshal(QueryModel{Type: "eval", Eval: "now()"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := ds.QueryData(ctx, &backend.QueryDataRequest{
+		Queries: []backend.DataQuery{{RefID: "A", JSON: rawJson}, {RefID: "B", JSON: rawJson}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, refID := range []string{"A", "B"} {
+		if resp.Responses[refID].Error == nil {
+			t.Errorf("%s: expected a cancellation error", refID)
+		}
+	}
+}
+
+func TestCheckHealth_LazyConnect(t *testing.T) {
+	client := &testHaystackClient{openErr: fmt.Errorf("connection refused")}
+	ds := Datasource{client: client}
+
+	result, err := ds.CheckHealth(context.Background(), &backend.CheckHealthRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Status != backend.HealthStatusError || result.Message != "haystack client opening: connection refused" {
+		t.Errorf("Expected an opening error, got %v: %s", result.Status, result.Message)
+	}
+
+	// The server comes up, and the next check connects
+	client.openErr = nil
+	result, err = ds.CheckHealth(context.Background(), &backend.CheckHealthRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Status != backend.HealthStatusOk {
+		t.Errorf("Expected an OK status, got %v: %s", result.Status, result.Message)
+	}
+	if client.opens != 2 {
+		t.Errorf("Expected 2 opens, got %d", client.opens)
+	}
+
+	// Once connected, the client isn't re-opened
+	_, err = ds.CheckHealth(context.Background(), &backend.CheckHealthRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if client.opens != 2 {
+		t.Errorf("Expected 2 opens, got %d", client.opens)
+	}
+}
+
+func TestCheckHealth_Details(t *testing.T) {
+	opNames := []string{"about", "ops", "formats", "read", "hisRead", "nav"}
+	// Older servers list the ops by name, and Haystack 4 servers as defs
+	nameOps := haystack.NewGridBuilder()
+	nameOps.AddCol("name", map[string]haystack.Val{})
+	defOps := haystack.NewGridBuilder()
+	defOps.AddCol("def", map[string]haystack.Val{})
+	for _, op := range opNames {
+		nameOps.AddRow([]haystack.Val{haystack.NewStr(op)})
+		defOps.AddRow([]haystack.Val{haystack.NewSymbol("op:" + op)})
+	}
+	formats := haystack.NewGridBuilder()
+	formats.AddCol("mime", map[string]haystack.Val{})
+	formats.AddRow([]haystack.Val{haystack.NewStr("text/zinc")})
+	formats.AddRow([]haystack.Val{haystack.NewStr("application/json")})
+
+	for name, opsGrid := range map[string]haystack.Grid{"name": nameOps.ToGrid(), "def": defOps.ToGrid()} {
+		client := &testHaystackClient{
+			aboutResponse: haystack.NewDict(map[string]haystack.Val{
+				"productName":     haystack.NewStr("SkySpark"),
+				"productVersion":  haystack.NewStr("3.1.8"),
+				"vendorName":      haystack.NewStr("SkyFoundry"),
+				"serverName":      haystack.NewStr("sky1"),
+				"haystackVersion": haystack.NewStr("4.0"),
+			}),
+			opsResponse:     &opsGrid,
+			formatsResponse: formats.ToGrid(),
+		}
+		ds := Datasource{client: client}
+
+		result, err := ds.CheckHealth(context.Background(), &backend.CheckHealthRequest{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if result.Status != backend.HealthStatusOk {
+			t.Errorf("%s: expected an OK status, got %v: %s", name, result.Status, result.Message)
+		}
+		expectedMessage := "Connected to SkySpark 3.1.8, with warnings: The `eval` op is not available for this user, so queries that use it will fail"
+		if result.Message != expectedMessage {
+			t.Errorf("%s: unexpected message: %s", name, result.Message)
+		}
+
+		var actual healthDetails
+		err = json.Unmarshal(result.JSONDetails, &actual)
+		if err != nil {
+			t.Fatal(err)
+		}
+		expected := healthDetails{
+			ProductName:     "SkySpark",
+			ProductVersion:  "3.1.8",
+			Vendor:          "SkyFoundry",
+			ServerName:      "sky1",
+			HaystackVersion: "4.0",
+			Ops:             opNames,
+			Formats:         []string{"text/zinc", "application/json"},
+			LatencyMs:       actual.LatencyMs,
+			Warnings:        []string{"The `eval` op is not available for this user, so queries that use it will fail"},
+		}
+		if !cmp.Equal(actual, expected) {
+			t.Errorf("%s: %s", name, cmp.Diff(actual, expected))
+		}
+	}
+}
+
+func TestQueryData_Reconnect(t *testing.T) {
+	response := haystack.NewGridBuilder()
+	response.AddCol("a", map[string]haystack.Val{})
+	response.AddRow([]haystack.Val{haystack.NewStr("a")})
+
+	// The server restarted, so the session is no longer valid
+	client := &testHaystackClient{
+		evalResponse: response.ToGrid(),
+		evalErrs:     []error{haystackClient.HTTPError{Code: 403, Msg: "Forbidden"}},
+	}
+	actual := getResponse(client, &QueryModel{Type: "eval", Eval: "{a: \"a\"}"}, t)
+
+	aVal := "a"
+	expected := data.NewFrame("",
+		data.NewField("a", nil, []*string{&aVal}).SetConfig(&data.FieldConfig{DisplayName: "a"}),
+	)
+	if !cmp.Equal(actual, expected, data.FrameTestCompareOptions()...) {
+		t.Error(cmp.Diff(actual, expected, data.FrameTestCompareOptions()...))
+	}
+	// Once by getResponse, once on first use, and once to reconnect
+	if client.opens != 3 {
+		t.Errorf("Expected 3 opens, got %d", client.opens)
+	}
+}
+
+func TestHttpClientOptions_TLS(t *testing.T) {
+	clientCert, clientKey := testCertificate(t)
+	clientPool := x509.NewCertPool()
+	clientPool.AppendCertsFromPEM(clientCert)
+
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	server.TLS = &tls.Config{ClientAuth: tls.RequireAndVerifyClientCert, ClientCAs: clientPool}
+	server.StartTLS()
+	defer server.Close()
+	caCert := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw})
+
+	tests := []struct {
+		name       string
+		jsonData   string
+		secure     map[string]string
+		shouldFail bool
+	}{
+		{
+			name:     "CA and client certificate",
+			jsonData: `{"tlsAuth": true, "tlsAuthWithCACert": true}`,
+			secure: map[string]string{
+				"tlsCACert":     string(caCert),
+				"tlsClientCert": string(clientCert),
+				"tlsClientKey":  string(clientKey),
+			},
+		},
+		{
+			name:     "Skip verify keeps client certificate",
+			jsonData: `{"tlsAuth": true, "skipTlsVerify": true}`,
+			secure: map[string]string{
+				"tlsClientCert": string(clientCert),
+				"tlsClientKey":  string(clientKey),
+			},
+		},
+		{
+			name:     "Server name override",
+			jsonData: `{"tlsAuth": true, "tlsAuthWithCACert": true, "serverName": "example.com"}`,
+			secure: map[string]string{
+				"tlsCACert":     string(caCert),
+				"tlsClientCert": string(clientCert),
+				"tlsClientKey":  string(clientKey),
+			},
+		},
+		{
+			name:     "Wrong server name",
+			jsonData: `{"tlsAuth": true, "tlsAuthWithCACert": true, "serverName": "wrong.test"}`,
+			secure: map[string]string{
+				"tlsCACert":     string(caCert),
+				"tlsClientCert": string(clientCert),
+				"tlsClientKey":  string(clientKey),
+			},
+			shouldFail: true,
+		},
+		{
+			name:     "Missing client certificate",
+			jsonData: `{"tlsAuthWithCACert": true}`,
+			secure: map[string]string{
+				"tlsCACert": string(caCert),
+			},
+			shouldFail: true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			settings := backend.DataSourceInstanceSettings{
+				JSONData:                []byte(test.jsonData),
+				DecryptedSecureJSONData: test.secure,
+			}
+			var options Options
+			err := json.Unmarshal(settings.JSONData, &options)
+			if err != nil {
+				t.Fatal(err)
+			}
+			httpClientOptions, err := httpClientOptions(context.Background(), settings, options)
+			if err != nil {
+				t.Fatal(err)
+			}
+			httpClient, err := httpclient.New(httpClientOptions)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			resp, err := httpClient.Get(server.URL)
+			if test.shouldFail {
+				if err == nil {
+					resp.Body.Close()
+					t.Error("Expected the request to fail")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+		})
+	}
+}
+
+// testCertificate returns a PEM-encoded self-signed client certificate and its key
+func testCertificate(t *testing.T) ([]byte, []byte) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "grafana"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, &template, &template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer})
+}
+
 func getResponse(
 	client HaystackClient,
 	queryModel *QueryModel,
 	t *testing.T,
+) *data.Frame {
+	return getResponseInRange(client, queryModel, backend.TimeRange{}, t)
+}
+
+func getResponseInRange(
+	client HaystackClient,
+	queryModel *QueryModel,
+	timeRange backend.TimeRange,
+	t *testing.T,
 ) *data.Frame {
 	if client.Open() != nil {
 		t.Fatal("Failed to open connection. Is a local Haxall server running?")
@@ -222,8 +1419,9 @@ func getResponse(
 		&backend.QueryDataRequest{
 			Queries: []backend.DataQuery{
 				{
-					RefID: refID,
-					JSON:  rawJson,
+					RefID:     refID,
+					JSON:      rawJson,
+					TimeRange: timeRange,
 				},
 			},
 		},
@@ -245,6 +1443,8 @@ func getResponse(
 	if len(queryResponse.Frames) != 1 {
 		t.Fatal("Currently only support single-frame results")
 	}
+	// The metadata includes timings, so it is tested separately
+	queryResponse.Frames[0].Meta = nil
 	return queryResponse.Frames[0]
 }
 
@@ -253,13 +1453,44 @@ type testHaystackClient struct {
 	navResponse       haystack.Grid
 	evalResponse      haystack.Grid
 	hisReadResponse   haystack.Grid
+	hisReadFunc       func(ref haystack.Ref) (haystack.Grid, error) // Handles HisRead calls, if set
 	readResponse      haystack.Grid
+	readResponses     map[string]haystack.Grid // Read responses by filter. Falls back to readRecords
+	readRecords       *haystack.Grid           // Records that Read evaluates the filter against. Falls back to readResponse
 	readByIdsResponse haystack.Grid
+	openErr           error                                    // Returned by Open, if set
+	opens             int                                      // The number of times Open was called
+	evalErrs          []error                                  // Returned by successive Eval calls, before evalResponse
+	evalFunc          func(expr string) (haystack.Grid, error) // Handles Eval calls, if set
+	aboutResponse     haystack.Dict
+	opsResponse       *haystack.Grid // Falls back to an empty grid
+	formatsResponse   haystack.Grid
+	defsResponse      haystack.Grid
+	libsResponse      haystack.Grid
+	filetypesResponse haystack.Grid
+	defsCalls         []testDefsCall // The calls to DefsWithFilter, LibsWithFilter, and FiletypesWithFilter
+	actionResponse    haystack.Grid
+	actionErr         error            // Returned by InvokeAction, if set
+	actionCalls       []testActionCall // The calls to InvokeAction
+}
+
+// testActionCall records the arguments of an InvokeAction call
+type testDefsCall struct {
+	op     string
+	filter string
+	limit  int
+}
+
+type testActionCall struct {
+	id     string
+	action string
+	args   map[string]haystack.Val
 }
 
-// Open is a no-op
+// Open returns openErr
 func (c *testHaystackClient) Open() error {
-	return nil
+	c.opens++
+	return c.openErr
 }
 
 // Close is a no-op
@@ -269,34 +1500,119 @@ func (c *testHaystackClient) Close() error {
 
 // About returns an empty dict
 func (c *testHaystackClient) About() (haystack.Dict, error) {
-	return haystack.Dict{}, nil
+	return c.aboutResponse, nil
 }
 
-// Ops returns an empty grid
+// Ops returns the opsResponse, or an empty grid
 func (c *testHaystackClient) Ops() (haystack.Grid, error) {
+	if c.opsResponse != nil {
+		return *c.opsResponse, nil
+	}
 	return haystack.EmptyGrid(), nil
 }
 
+// Formats returns the formatsResponse
+func (c *testHaystackClient) Formats() (haystack.Grid, error) {
+	return c.formatsResponse, nil
+}
+
 func (c *testHaystackClient) Nav(navId haystack.Val) (haystack.Grid, error) {
 	return c.navResponse, nil
 }
 
 // Eval returns the EvalResponse
 func (c *testHaystackClient) Eval(query string) (haystack.Grid, error) {
+	if c.evalFunc != nil {
+		return c.evalFunc(query)
+	}
+	if len(c.evalErrs) > 0 {
+		err := c.evalErrs[0]
+		c.evalErrs = c.evalErrs[1:]
+		return haystack.EmptyGrid(), err
+	}
 	return c.evalResponse, nil
 }
 
 // HisRead returns the HisReadResponse
 func (c *testHaystackClient) HisReadAbsDateTime(ref haystack.Ref, start haystack.DateTime, end haystack.DateTime) (haystack.Grid, error) {
+	if c.hisReadFunc != nil {
+		return c.hisReadFunc(ref)
+	}
 	return c.hisReadResponse, nil
 }
 
-// Read returns the ReadResponse
+// Read returns the ReadResponses entry for the query, the ReadRecords that match the query, or the ReadResponse
 func (c *testHaystackClient) Read(query string) (haystack.Grid, error) {
+	if response, ok := c.readResponses[query]; ok {
+		return response, nil
+	}
+	if c.readRecords != nil {
+		node, err := filter.Parse(query)
+		if err != nil {
+			return haystack.EmptyGrid(), err
+		}
+		records := map[string]haystack.Dict{}
+		for _, row := range c.readRecords.Rows() {
+			if id, ok := row.Get("id").(haystack.Ref); ok {
+				records[id.Id()] = dictFromRow(*c.readRecords, row)
+			}
+		}
+		resolver := func(id haystack.Ref) (haystack.Dict, bool) {
+			record, ok := records[id.Id()]
+			return record, ok
+		}
+
+		response := haystack.NewGridBuilder()
+		for _, col := range c.readRecords.Cols() {
+			response.AddCol(col.Name(), map[string]haystack.Val{})
+		}
+		for _, row := range c.readRecords.Rows() {
+			if filter.Matches(node, dictFromRow(*c.readRecords, row), resolver) {
+				vals := []haystack.Val{}
+				for _, col := range c.readRecords.Cols() {
+					vals = append(vals, row.Get(col.Name()))
+				}
+				response.AddRow(vals)
+			}
+		}
+		return response.ToGrid(), nil
+	}
 	return c.readResponse, nil
 }
 
+// DefsWithFilter records the call and returns the defsResponse
+func (c *testHaystackClient) DefsWithFilter(filter string, limit int) (haystack.Grid, error) {
+	c.defsCalls = append(c.defsCalls, testDefsCall{op: "defs", filter: filter, limit: limit})
+	return c.defsResponse, nil
+}
+
+// LibsWithFilter records the call and returns the libsResponse
+func (c *testHaystackClient) LibsWithFilter(filter string, limit int) (haystack.Grid, error) {
+	c.defsCalls = append(c.defsCalls, testDefsCall{op: "libs", filter: filter, limit: limit})
+	return c.libsResponse, nil
+}
+
+// FiletypesWithFilter records the call and returns the filetypesResponse
+func (c *testHaystackClient) FiletypesWithFilter(filter string, limit int) (haystack.Grid, error) {
+	c.defsCalls = append(c.defsCalls, testDefsCall{op: "filetypes", filter: filter, limit: limit})
+	return c.filetypesResponse, nil
+}
+
+// InvokeAction records the call and returns the actionResponse
+func (c *testHaystackClient) InvokeAction(id haystack.Ref, action string, args map[string]haystack.Val) (haystack.Grid, error) {
+	c.actionCalls = append(c.actionCalls, testActionCall{id: id.Id(), action: action, args: args})
+	if c.actionErr != nil {
+		return haystack.EmptyGrid(), c.actionErr
+	}
+	return c.actionResponse, nil
+}
+
 // Read returns the ReadByIdsResponse
 func (c *testHaystackClient) ReadByIds(refs []haystack.Ref) (haystack.Grid, error) {
 	return c.readByIdsResponse, nil
 }
+
+// ptr returns a pointer to the value, for building expected fields
+func ptr[T any](value T) *T {
+	return &value
+}
@@ -0,0 +1,187 @@
+package plugin
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/NeedleInAJayStack/haystack"
+	"github.com/NeedleInAJayStack/haystack-datasource/pkg/filter"
+	"github.com/grafana/grafana-plugin-sdk-go/backend/log"
+	"github.com/grafana/grafana-plugin-sdk-go/data"
+)
+
+// defsLimit is the maximum number of records read by the `defs`, `libs`, and `filetypes` ops. The limit is always
+// sent, since the client sends a zero limit as is, which servers read as "no records".
+const defsLimit = 10000
+
+// defs returns the records of the Haystack 4 `defs`, `libs`, or `filetypes` op that match the filter.
+// An empty filter returns all records, up to defsLimit. The filter is validated before it is sent to the server.
+// Protos aren't supported, since Haystack 4 defines no op that lists them.
+func (datasource *Datasource) defs(ctx context.Context, op string, filterStr string, variables map[string]string) (haystack.Grid, error) {
+	filterStr = strings.TrimSpace(interpolate(filterStr, variables))
+	if filterStr != "" {
+		_, err := filter.Parse(filterStr)
+		if err != nil {
+			return haystack.EmptyGrid(), err
+		}
+	}
+
+	return datasource.withRetry(
+		ctx,
+		op,
+		func() (haystack.Grid, error) {
+			switch op {
+			case "libs":
+				return datasource.client.LibsWithFilter(filterStr, defsLimit)
+			case "filetypes":
+				return datasource.client.FiletypesWithFilter(filterStr, defsLimit)
+			default:
+				return datasource.client.DefsWithFilter(filterStr, defsLimit)
+			}
+		},
+	)
+}
+
+// defsFrameFromGrid converts a grid of def records to a frame with `def`, `lib`, `is`, and `doc` fields.
+// Symbols are shown by name, and the `is` field lists the supertypes of the def, separated by commas.
+func defsFrameFromGrid(name string, grid haystack.Grid) *data.Frame {
+	defs := []*string{}
+	libs := []*string{}
+	supertypes := []*string{}
+	docs := []*string{}
+	for _, row := range grid.Rows() {
+		defs = append(defs, symbolName(row.Get("def")))
+		libs = append(libs, symbolName(row.Get("lib")))
+
+		var is *string
+		switch val := row.Get("is").(type) {
+		case haystack.Symbol:
+			is = symbolName(val)
+		case haystack.List:
+			names := []string{}
+			for i := 0; i < val.Size(); i++ {
+				if supertype := symbolName(val.Get(i)); supertype != nil {
+					names = append(names, *supertype)
+				}
+			}
+			joined := strings.Join(names, ", ")
+			is = &joined
+		}
+		supertypes = append(supertypes, is)
+
+		var doc *string
+		if str, ok := row.Get("doc").(haystack.Str); ok {
+			value := str.String()
+			doc = &value
+		}
+		docs = append(docs, doc)
+	}
+
+	return data.NewFrame(
+		name,
+		data.NewField("def", nil, defs),
+		data.NewField("lib", nil, libs),
+		data.NewField("is", nil, supertypes),
+		data.NewField("doc", nil, docs),
+	)
+}
+
+// symbolName returns the name of the Symbol, without the `^` prefix, or nil if the value isn't a Symbol
+func symbolName(val haystack.Val) *string {
+	symbol, ok := val.(haystack.Symbol)
+	if !ok {
+		return nil
+	}
+	name := strings.TrimPrefix(symbol.ToZinc(), "^")
+	return &name
+}
+
+// tagsCacheTTL is how long the tags defined by the server are cached, since the tag picker requests them often
+const tagsCacheTTL = 5 * time.Minute
+
+// tagsCache holds the tags defined by the server
+type tagsCache struct {
+	mutex    sync.Mutex
+	tags     []TagSuggestion
+	cachedAt time.Time
+}
+
+// TagSuggestion is a tag that can be used in filters, as returned by the `tags` resource
+type TagSuggestion struct {
+	Name string `json:"name"`
+	Doc  string `json:"doc,omitempty"`
+}
+
+// handleTags responds with the tags defined by the server, for autocompletion of filters
+func (datasource *Datasource) handleTags(writer http.ResponseWriter, request *http.Request) {
+	if request.Method != http.MethodGet {
+		http.Error(writer, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	tags, err := datasource.tags(request.Context())
+	if err != nil {
+		log.DefaultLogger.Error(err.Error())
+		http.Error(writer, fmt.Sprintf("defs failure: %v", err.Error()), http.StatusBadRequest)
+		return
+	}
+
+	writer.Header().Set("Content-Type", "application/json")
+	err = json.NewEncoder(writer).Encode(tags)
+	if err != nil {
+		log.DefaultLogger.Error(err.Error())
+	}
+}
+
+// tags returns the defs that can be used as tags, sorted by name. They are cached for tagsCacheTTL.
+func (datasource *Datasource) tags(ctx context.Context) ([]TagSuggestion, error) {
+	cache := &datasource.tagsCache
+	cache.mutex.Lock()
+	cached, cachedAt := cache.tags, cache.cachedAt
+	cache.mutex.Unlock()
+	if cached != nil && time.Since(cachedAt) < tagsCacheTTL {
+		return cached, nil
+	}
+
+	tags, err := datasource.readTags(ctx)
+	if err != nil {
+		return nil, err
+	}
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+	cache.tags = tags
+	cache.cachedAt = time.Now()
+	return tags, nil
+}
+
+// readTags reads the defs that can be used as tags, sorted by name. Conjuncts, like `elec-meter`, and feature
+// keys, like `op:read`, are excluded since they aren't tag names.
+func (datasource *Datasource) readTags(ctx context.Context) ([]TagSuggestion, error) {
+	defs, err := datasource.defs(ctx, "defs", "", map[string]string{})
+	if err != nil {
+		return nil, err
+	}
+
+	tags := []TagSuggestion{}
+	for _, row := range defs.Rows() {
+		name := symbolName(row.Get("def"))
+		if name == nil || strings.ContainsAny(*name, "-:") {
+			continue
+		}
+		tag := TagSuggestion{Name: *name}
+		if doc, ok := row.Get("doc").(haystack.Str); ok {
+			tag.Doc = doc.String()
+		}
+		tags = append(tags, tag)
+	}
+	sort.Slice(tags, func(i, j int) bool {
+		return tags[i].Name < tags[j].Name
+	})
+	return tags, nil
+}
@@ -0,0 +1,130 @@
+package plugin
+
+import (
+	"context"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/NeedleInAJayStack/haystack"
+	"github.com/google/go-cmp/cmp"
+	"github.com/grafana/grafana-plugin-sdk-go/data"
+)
+
+func defsGrid() haystack.Grid {
+	grid := haystack.NewGridBuilder()
+	grid.AddCol("def", map[string]haystack.Val{})
+	grid.AddCol("lib", map[string]haystack.Val{})
+	grid.AddCol("is", map[string]haystack.Val{})
+	grid.AddCol("doc", map[string]haystack.Val{})
+	grid.AddRow([]haystack.Val{
+		haystack.NewSymbol("site"),
+		haystack.NewSymbol("lib:phIoT"),
+		haystack.NewList([]haystack.Val{haystack.NewSymbol("marker"), haystack.NewSymbol("entity")}),
+		haystack.NewStr("Site is a geographic location of the built environment"),
+	})
+	grid.AddRow([]haystack.Val{
+		haystack.NewSymbol("elec-meter"),
+		haystack.NewSymbol("lib:phIoT"),
+		haystack.NewSymbol("meter"),
+		haystack.NewStr("Electricity meter"),
+	})
+	grid.AddRow([]haystack.Val{
+		haystack.NewSymbol("op:read"),
+		haystack.NewSymbol("lib:phict"),
+		haystack.NewList([]haystack.Val{haystack.NewSymbol("op")}),
+		haystack.NewNull(),
+	})
+	grid.AddRow([]haystack.Val{
+		haystack.NewSymbol("area"),
+		haystack.NewSymbol("lib:phIoT"),
+		haystack.NewList([]haystack.Val{haystack.NewSymbol("number")}),
+		haystack.NewStr("Area of a floor plan"),
+	})
+	return grid.ToGrid()
+}
+
+func TestQueryData_Defs(t *testing.T) {
+	client := &testHaystackClient{defsResponse: defsGrid()}
+
+	actual := getResponse(client, &QueryModel{Type: "defs", Defs: "lib==^lib:phIoT"}, t)
+	expected := data.NewFrame("defs",
+		data.NewField("def", nil, []*string{ptr("site"), ptr("elec-meter"), ptr("op:read"), ptr("area")}),
+		data.NewField("lib", nil, []*string{ptr("lib:phIoT"), ptr("lib:phIoT"), ptr("lib:phict"), ptr("lib:phIoT")}),
+		data.NewField("is", nil, []*string{ptr("marker, entity"), ptr("meter"), ptr("op"), ptr("number")}),
+		data.NewField("doc", nil, []*string{
+			ptr("Site is a geographic location of the built environment"),
+			ptr("Electricity meter"),
+			nil,
+			ptr("Area of a floor plan"),
+		}),
+	)
+	if !cmp.Equal(actual, expected, data.FrameTestCompareOptions()...) {
+		t.Error(cmp.Diff(actual, expected, data.FrameTestCompareOptions()...))
+	}
+	expectedCalls := []testDefsCall{{op: "defs", filter: "lib==^lib:phIoT", limit: defsLimit}}
+	if !slices.Equal(client.defsCalls, expectedCalls) {
+		t.Errorf("Expected the filter and limit to be sent to the server, got %v", client.defsCalls)
+	}
+}
+
+func TestQueryData_Libs(t *testing.T) {
+	libs := haystack.NewGridBuilder()
+	libs.AddCol("def", map[string]haystack.Val{})
+	libs.AddCol("is", map[string]haystack.Val{})
+	libs.AddRow([]haystack.Val{haystack.NewSymbol("lib:phIoT"), haystack.NewList([]haystack.Val{haystack.NewSymbol("lib")})})
+	client := &testHaystackClient{libsResponse: libs.ToGrid()}
+
+	actual := getResponse(client, &QueryModel{Type: "libs"}, t)
+	expected := data.NewFrame("libs",
+		data.NewField("def", nil, []*string{ptr("lib:phIoT")}),
+		data.NewField("lib", nil, []*string{nil}),
+		data.NewField("is", nil, []*string{ptr("lib")}),
+		data.NewField("doc", nil, []*string{nil}),
+	)
+	if !cmp.Equal(actual, expected, data.FrameTestCompareOptions()...) {
+		t.Error(cmp.Diff(actual, expected, data.FrameTestCompareOptions()...))
+	}
+	expectedCalls := []testDefsCall{{op: "libs", filter: "", limit: defsLimit}}
+	if !slices.Equal(client.defsCalls, expectedCalls) {
+		t.Errorf("Expected an empty filter and the limit to be sent to the server, got %v", client.defsCalls)
+	}
+}
+
+func TestTags(t *testing.T) {
+	client := &testHaystackClient{defsResponse: defsGrid()}
+	ds := Datasource{client: client}
+
+	actual, err := ds.tags(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []TagSuggestion{
+		{Name: "area", Doc: "Area of a floor plan"},
+		{Name: "site", Doc: "Site is a geographic location of the built environment"},
+	}
+	if !cmp.Equal(actual, expected) {
+		t.Error(cmp.Diff(actual, expected))
+	}
+	expectedCalls := []testDefsCall{{op: "defs", filter: "", limit: defsLimit}}
+	if !slices.Equal(client.defsCalls, expectedCalls) {
+		t.Errorf("Expected all defs to be read, got %v", client.defsCalls)
+	}
+
+	// The tags are cached until they expire
+	_, err = ds.tags(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(client.defsCalls) != 1 {
+		t.Errorf("Expected the cached tags to be used, got %d defs calls", len(client.defsCalls))
+	}
+	ds.tagsCache.cachedAt = time.Now().Add(-2 * tagsCacheTTL)
+	_, err = ds.tags(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(client.defsCalls) != 2 {
+		t.Errorf("Expected the expired tags to be read again, got %d defs calls", len(client.defsCalls))
+	}
+}
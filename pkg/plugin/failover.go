@@ -0,0 +1,224 @@
+package plugin
+
+import (
+	"errors"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/NeedleInAJayStack/haystack"
+	"github.com/NeedleInAJayStack/haystack/client"
+	"github.com/grafana/grafana-plugin-sdk-go/backend/log"
+)
+
+// While failed over, the primary endpoint is checked for recovery at this interval
+const primaryCheckInterval = time.Minute
+
+// failoverClient is a HaystackClient that sends its requests to one of several endpoints. The Datasource moves it
+// to the next endpoint when the current one fails. While failed over, the primary endpoint is checked in the
+// background, and becomes current again once it recovers.
+type failoverClient struct {
+	urls          []string
+	clients       []HaystackClient
+	checkInterval time.Duration // The interval of the primary endpoint checks
+	stop          chan struct{} // Closed by Close, to stop the primary endpoint checks
+
+	mutex    sync.Mutex
+	current  int
+	checking bool // Whether the primary endpoint is being checked
+	stopped  bool
+}
+
+func newFailoverClient(urls []string, clients []HaystackClient) *failoverClient {
+	return &failoverClient{urls: urls, clients: clients, checkInterval: primaryCheckInterval, stop: make(chan struct{})}
+}
+
+// endpoint returns the index and client of the current endpoint
+func (failover *failoverClient) endpoint() (int, HaystackClient) {
+	failover.mutex.Lock()
+	defer failover.mutex.Unlock()
+	return failover.current, failover.clients[failover.current]
+}
+
+// next moves to the endpoint after the failed one. If another request has already moved away from the failed
+// endpoint, the current endpoint is kept.
+func (failover *failoverClient) next(failed int, err error) {
+	failover.mutex.Lock()
+	defer failover.mutex.Unlock()
+	if failover.current != failed {
+		return
+	}
+	failover.current = (failed + 1) % len(failover.clients)
+	log.DefaultLogger.Warn("Haystack endpoint failed, failing over", "failed", failover.urls[failed], "next", failover.urls[failover.current], "error", err.Error())
+	if failover.current != 0 && !failover.checking && !failover.stopped {
+		failover.checking = true
+		go failover.checkPrimary()
+	}
+}
+
+// checkPrimary checks the primary endpoint every checkInterval until it recovers, when it becomes current again,
+// or the client is closed. The primary endpoint is opened as part of the check, so it is ready to use.
+func (failover *failoverClient) checkPrimary() {
+	ticker := time.NewTicker(failover.checkInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-failover.stop:
+			return
+		case <-ticker.C:
+		}
+
+		primary := failover.clients[0]
+		err := primary.Open()
+		if err == nil {
+			_, err = primary.About()
+		}
+		if err != nil {
+			log.DefaultLogger.Debug("Primary Haystack endpoint has not recovered", "url", failover.urls[0], "error", err.Error())
+			continue
+		}
+
+		failover.mutex.Lock()
+		if failover.current != 0 {
+			log.DefaultLogger.Info("Primary Haystack endpoint recovered", "url", failover.urls[0])
+			failover.current = 0
+		}
+		failover.checking = false
+		failover.mutex.Unlock()
+		return
+	}
+}
+
+// stopChecks stops checking the primary endpoint
+func (failover *failoverClient) stopChecks() {
+	failover.mutex.Lock()
+	defer failover.mutex.Unlock()
+	if !failover.stopped {
+		failover.stopped = true
+		close(failover.stop)
+	}
+}
+
+// endpointHealth is the health of one endpoint of a failoverClient
+type endpointHealth struct {
+	Url       string `json:"url"`
+	Current   bool   `json:"current"`
+	Ok        bool   `json:"ok"`
+	Error     string `json:"error,omitempty"`
+	LatencyMs int64  `json:"latencyMs"`
+}
+
+// checkEndpoints opens each endpoint and requests its about
+func (failover *failoverClient) checkEndpoints() []endpointHealth {
+	current, _ := failover.endpoint()
+	healths := make([]endpointHealth, len(failover.clients))
+	for i, endpoint := range failover.clients {
+		start := time.Now()
+		err := endpoint.Open()
+		if err == nil {
+			_, err = endpoint.About()
+		}
+		healths[i] = endpointHealth{
+			Url:       failover.urls[i],
+			Current:   i == current,
+			Ok:        err == nil,
+			LatencyMs: time.Since(start).Milliseconds(),
+		}
+		if err != nil {
+			healths[i].Error = err.Error()
+		}
+	}
+	return healths
+}
+
+// isEndpointFailure returns true if the error means the server is unavailable, rather than that the request failed
+func isEndpointFailure(err error) bool {
+	var urlErr *url.Error
+	if errors.As(err, &urlErr) {
+		return true
+	}
+	var httpErr client.HTTPError
+	if errors.As(err, &httpErr) {
+		return httpErr.Code >= 500
+	}
+	return false
+}
+
+// Open opens the current endpoint
+func (failover *failoverClient) Open() error {
+	_, endpoint := failover.endpoint()
+	return endpoint.Open()
+}
+
+// Close stops checking the primary endpoint, and closes all endpoints, since any of them may have been opened
+func (failover *failoverClient) Close() error {
+	failover.stopChecks()
+	var closeErr error
+	for _, endpoint := range failover.clients {
+		err := endpoint.Close()
+		if closeErr == nil {
+			closeErr = err
+		}
+	}
+	return closeErr
+}
+
+func (failover *failoverClient) About() (haystack.Dict, error) {
+	_, endpoint := failover.endpoint()
+	return endpoint.About()
+}
+
+func (failover *failoverClient) Ops() (haystack.Grid, error) {
+	_, endpoint := failover.endpoint()
+	return endpoint.Ops()
+}
+
+func (failover *failoverClient) Formats() (haystack.Grid, error) {
+	_, endpoint := failover.endpoint()
+	return endpoint.Formats()
+}
+
+func (failover *failoverClient) Eval(expr string) (haystack.Grid, error) {
+	_, endpoint := failover.endpoint()
+	return endpoint.Eval(expr)
+}
+
+func (failover *failoverClient) HisReadAbsDateTime(id haystack.Ref, start haystack.DateTime, end haystack.DateTime) (haystack.Grid, error) {
+	_, endpoint := failover.endpoint()
+	return endpoint.HisReadAbsDateTime(id, start, end)
+}
+
+func (failover *failoverClient) Read(filter string) (haystack.Grid, error) {
+	_, endpoint := failover.endpoint()
+	return endpoint.Read(filter)
+}
+
+func (failover *failoverClient) ReadByIds(ids []haystack.Ref) (haystack.Grid, error) {
+	_, endpoint := failover.endpoint()
+	return endpoint.ReadByIds(ids)
+}
+
+func (failover *failoverClient) Nav(navId haystack.Val) (haystack.Grid, error) {
+	_, endpoint := failover.endpoint()
+	return endpoint.Nav(navId)
+}
+
+func (failover *failoverClient) DefsWithFilter(filter string, limit int) (haystack.Grid, error) {
+	_, endpoint := failover.endpoint()
+	return endpoint.DefsWithFilter(filter, limit)
+}
+
+func (failover *failoverClient) LibsWithFilter(filter string, limit int) (haystack.Grid, error) {
+	_, endpoint := failover.endpoint()
+	return endpoint.LibsWithFilter(filter, limit)
+}
+
+func (failover *failoverClient) FiletypesWithFilter(filter string, limit int) (haystack.Grid, error) {
+	_, endpoint := failover.endpoint()
+	return endpoint.FiletypesWithFilter(filter, limit)
+}
+
+func (failover *failoverClient) InvokeAction(id haystack.Ref, action string, args map[string]haystack.Val) (haystack.Grid, error) {
+	_, endpoint := failover.endpoint()
+	return endpoint.InvokeAction(id, action, args)
+}
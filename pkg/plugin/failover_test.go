@@ -0,0 +1,171 @@
+package plugin
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/NeedleInAJayStack/haystack"
+	haystackClient "github.com/NeedleInAJayStack/haystack/client"
+	"github.com/google/go-cmp/cmp"
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+)
+
+func TestFailover(t *testing.T) {
+	response := haystack.NewGridBuilder()
+	response.AddCol("a", map[string]haystack.Val{})
+	response.AddRow([]haystack.Val{haystack.NewStr("a")})
+
+	connectionErr := &url.Error{Op: "Post", URL: "http://primary/api/eval", Err: fmt.Errorf("connection refused")}
+	primary := &testHaystackClient{
+		evalResponse: response.ToGrid(),
+		evalErrs:     []error{connectionErr},
+	}
+	secondary := &testHaystackClient{
+		evalResponse: response.ToGrid(),
+		evalErrs:     []error{haystackClient.HTTPError{Code: 503, Msg: "Service Unavailable"}},
+	}
+	tertiary := &testHaystackClient{
+		evalResponse: response.ToGrid(),
+	}
+	failover := newFailoverClient(
+		[]string{"http://primary/api/", "http://secondary/api/", "http://tertiary/api/"},
+		[]HaystackClient{primary, secondary, tertiary},
+	)
+	ds := Datasource{client: failover}
+
+	_, err := ds.eval(context.Background(), "readAll(site)", map[string]string{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if current, _ := failover.endpoint(); current != 2 {
+		t.Errorf("Expected to fail over to the third endpoint, got %d", current)
+	}
+	if tertiary.opens != 1 {
+		t.Errorf("Expected the third endpoint to be opened once, got %d", tertiary.opens)
+	}
+
+	// The primary isn't checked until the interval has passed
+	_, err = ds.eval(context.Background(), "readAll(site)", map[string]string{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if current, _ := failover.endpoint(); current != 2 {
+		t.Errorf("Expected to stay on the third endpoint, got %d", current)
+	}
+	ds.close()
+}
+
+// recoveringClient is a testHaystackClient whose Open fails until it recovers. It is safe to use concurrently.
+type recoveringClient struct {
+	testHaystackClient
+	recovered atomic.Bool
+	checks    atomic.Int32
+}
+
+func (c *recoveringClient) Open() error {
+	c.checks.Add(1)
+	if !c.recovered.Load() {
+		return &url.Error{Op: "Post", URL: "http://primary/api/about", Err: fmt.Errorf("connection refused")}
+	}
+	return nil
+}
+
+func (c *recoveringClient) About() (haystack.Dict, error) {
+	return haystack.NewDict(map[string]haystack.Val{}), nil
+}
+
+func TestFailover_PrimaryCheck(t *testing.T) {
+	primary := &recoveringClient{}
+	failover := newFailoverClient([]string{"http://primary/api/", "http://secondary/api/"}, []HaystackClient{primary, &testHaystackClient{}})
+	failover.checkInterval = 5 * time.Millisecond
+
+	// The primary is checked in the background, and becomes current once it recovers
+	failover.next(0, fmt.Errorf("connection refused"))
+	time.Sleep(20 * time.Millisecond)
+	if current, _ := failover.endpoint(); current != 1 {
+		t.Errorf("Expected to stay on the secondary endpoint, got %d", current)
+	}
+	primary.recovered.Store(true)
+	time.Sleep(20 * time.Millisecond)
+	if current, _ := failover.endpoint(); current != 0 {
+		t.Errorf("Expected to return to the primary endpoint, got %d", current)
+	}
+
+	// Closing the client stops the checks
+	primary.recovered.Store(false)
+	failover.next(0, fmt.Errorf("connection refused"))
+	failover.Close()
+	time.Sleep(10 * time.Millisecond)
+	checks := primary.checks.Load()
+	time.Sleep(20 * time.Millisecond)
+	if primary.checks.Load() != checks {
+		t.Error("Expected the checks to stop once the client is closed")
+	}
+}
+
+func TestFailover_RequestError(t *testing.T) {
+	// Errors caused by the request itself don't fail over
+	primary := &testHaystackClient{
+		evalErrs: []error{haystackClient.HTTPError{Code: 400, Msg: "Bad Request"}},
+	}
+	secondary := &testHaystackClient{}
+	failover := newFailoverClient([]string{"http://primary/api/", "http://secondary/api/"}, []HaystackClient{primary, secondary})
+	ds := Datasource{client: failover}
+
+	_, err := ds.eval(context.Background(), "readAll(", map[string]string{})
+	if err == nil {
+		t.Fatal("Expected an error")
+	}
+	if current, _ := failover.endpoint(); current != 0 {
+		t.Errorf("Expected to stay on the primary endpoint, got %d", current)
+	}
+}
+
+func TestFailover_CheckHealth(t *testing.T) {
+	connectionErr := &url.Error{Op: "Post", URL: "http://primary/api/about", Err: fmt.Errorf("connection refused")}
+	primary := &testHaystackClient{openErr: connectionErr}
+	secondary := &testHaystackClient{}
+	failover := newFailoverClient([]string{"http://primary/api/", "http://secondary/api/"}, []HaystackClient{primary, secondary})
+	ds := Datasource{client: failover}
+	defer ds.close()
+
+	result, err := ds.CheckHealth(context.Background(), &backend.CheckHealthRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Status != backend.HealthStatusOk {
+		t.Errorf("Expected an OK status, got %v: %s", result.Status, result.Message)
+	}
+
+	var details healthDetails
+	err = json.Unmarshal(result.JSONDetails, &details)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := range details.Endpoints {
+		details.Endpoints[i].LatencyMs = 0
+	}
+	expected := []endpointHealth{
+		{Url: "http://primary/api/", Current: false, Ok: false, Error: `Post "http://primary/api/about": connection refused`},
+		{Url: "http://secondary/api/", Current: true, Ok: true},
+	}
+	if !cmp.Equal(details.Endpoints, expected) {
+		t.Error(cmp.Diff(details.Endpoints, expected))
+	}
+}
+
+func TestOptions_Urls(t *testing.T) {
+	options := Options{
+		Url:  "http://primary/api/",
+		Urls: []string{"http://secondary/api/", " ", "http://primary/api/", "http://tertiary/api/"},
+	}
+	expected := []string{"http://primary/api/", "http://secondary/api/", "http://tertiary/api/"}
+	if !cmp.Equal(options.urls(), expected) {
+		t.Error(cmp.Diff(options.urls(), expected))
+	}
+}
@@ -10,9 +10,14 @@ type HaystackClient interface {
 	Close() error
 	About() (haystack.Dict, error)
 	Ops() (haystack.Grid, error)
+	Formats() (haystack.Grid, error)
 	Eval(string) (haystack.Grid, error)
 	HisReadAbsDateTime(haystack.Ref, haystack.DateTime, haystack.DateTime) (haystack.Grid, error)
 	Read(string) (haystack.Grid, error)
 	ReadByIds([]haystack.Ref) (haystack.Grid, error)
 	Nav(haystack.Val) (haystack.Grid, error)
+	DefsWithFilter(string, int) (haystack.Grid, error)
+	LibsWithFilter(string, int) (haystack.Grid, error)
+	FiletypesWithFilter(string, int) (haystack.Grid, error)
+	InvokeAction(haystack.Ref, string, map[string]haystack.Val) (haystack.Grid, error)
 }
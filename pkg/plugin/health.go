@@ -0,0 +1,169 @@
+package plugin
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/NeedleInAJayStack/haystack"
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+)
+
+// The ops used by the plugin's query types. Query types that use an unavailable op will fail.
+var queryOps = []string{"hisRead", "read", "eval", "nav"}
+
+// healthDetails describes the server in a health check result
+type healthDetails struct {
+	ProductName     string           `json:"productName"`
+	ProductVersion  string           `json:"productVersion"`
+	Vendor          string           `json:"vendor"`
+	ServerName      string           `json:"serverName"`
+	HaystackVersion string           `json:"haystackVersion"`
+	Ops             []string         `json:"ops"`
+	Formats         []string         `json:"formats"`
+	LatencyMs       int64            `json:"latencyMs"` // The round-trip time of the `about` request
+	Warnings        []string         `json:"warnings,omitempty"`
+	Endpoints       []endpointHealth `json:"endpoints,omitempty"` // The health of each URL, if there are several
+}
+
+// checkHealth requests the server's about, ops, and formats, and reports them with any capabilities that are missing
+func (datasource *Datasource) checkHealth(ctx context.Context) *backend.CheckHealthResult {
+	var about haystack.Dict
+	var latency time.Duration
+	_, err := datasource.withRetry(
+		ctx,
+		"about",
+		func() (haystack.Grid, error) {
+			start := time.Now()
+			var err error
+			about, err = datasource.client.About()
+			latency = time.Since(start)
+			return haystack.EmptyGrid(), err
+		},
+	)
+	if err != nil {
+		return &backend.CheckHealthResult{
+			Status:  backend.HealthStatusError,
+			Message: err.Error(),
+		}
+	}
+
+	details := healthDetails{
+		ProductName:     dictStr(about, "productName"),
+		ProductVersion:  dictStr(about, "productVersion"),
+		Vendor:          dictStr(about, "vendorName"),
+		ServerName:      dictStr(about, "serverName"),
+		HaystackVersion: dictStr(about, "haystackVersion"),
+		Ops:             []string{},
+		Formats:         []string{},
+		LatencyMs:       latency.Milliseconds(),
+	}
+
+	ops, err := datasource.ops(ctx)
+	if err != nil {
+		details.Warnings = append(details.Warnings, fmt.Sprintf("Unable to read ops: %v", err.Error()))
+	} else {
+		details.Ops = opNames(ops)
+		for _, op := range queryOps {
+			if !hasOp(ops, op) {
+				details.Warnings = append(details.Warnings, fmt.Sprintf("The `%s` op is not available for this user, so queries that use it will fail", op))
+			}
+		}
+	}
+
+	formats, err := datasource.withRetry(
+		ctx,
+		"formats",
+		func() (haystack.Grid, error) {
+			return datasource.client.Formats()
+		},
+	)
+	if err != nil {
+		details.Warnings = append(details.Warnings, fmt.Sprintf("Unable to read formats: %v", err.Error()))
+	} else {
+		details.Formats = colStrs(formats, "mime")
+	}
+
+	if failover, isFailover := datasource.client.(*failoverClient); isFailover {
+		details.Endpoints = failover.checkEndpoints()
+		for _, endpoint := range details.Endpoints {
+			if !endpoint.Ok {
+				details.Warnings = append(details.Warnings, fmt.Sprintf("%s is unavailable: %s", endpoint.Url, endpoint.Error))
+			}
+		}
+	}
+
+	jsonDetails, err := json.Marshal(details)
+	if err != nil {
+		return &backend.CheckHealthResult{
+			Status:  backend.HealthStatusError,
+			Message: fmt.Sprintf("health details: %v", err.Error()),
+		}
+	}
+
+	message := "Data source is working"
+	if details.ProductName != "" {
+		message = fmt.Sprintf("Connected to %s %s", details.ProductName, details.ProductVersion)
+	}
+	if len(details.Warnings) > 0 {
+		message += ", with warnings: " + strings.Join(details.Warnings, "; ")
+	}
+	return &backend.CheckHealthResult{
+		Status:      backend.HealthStatusOk,
+		Message:     message,
+		JSONDetails: jsonDetails,
+	}
+}
+
+// dictStr returns the value of the tag as a string, or an empty string if it is missing
+func dictStr(dict haystack.Dict, name string) string {
+	switch val := dict.Get(name).(type) {
+	case haystack.Str:
+		return val.String()
+	case haystack.Null:
+		return ""
+	default:
+		return val.ToZinc()
+	}
+}
+
+// hasOp returns whether the `ops` grid includes the op. Haystack 4 servers list ops by `def`, like `^op:eval`,
+// and older servers by `name`.
+func hasOp(ops haystack.Grid, op string) bool {
+	for _, row := range ops.Rows() {
+		if name, ok := row.Get("name").(haystack.Str); ok && name.String() == op {
+			return true
+		}
+		if def := symbolName(row.Get("def")); def != nil && *def == "op:"+op {
+			return true
+		}
+	}
+	return false
+}
+
+// opNames returns the names of the ops in the `ops` grid. Haystack 4 servers list each op as a `def` symbol, like
+// `^op:read`, and older servers as a `name` string.
+func opNames(ops haystack.Grid) []string {
+	names := []string{}
+	for _, row := range ops.Rows() {
+		if name, ok := row.Get("name").(haystack.Str); ok {
+			names = append(names, name.String())
+		} else if def := symbolName(row.Get("def")); def != nil {
+			names = append(names, strings.TrimPrefix(*def, "op:"))
+		}
+	}
+	return names
+}
+
+// colStrs returns the non-null string values of the column
+func colStrs(grid haystack.Grid, colName string) []string {
+	strs := []string{}
+	for i := 0; i < grid.RowCount(); i++ {
+		if str, ok := grid.RowAt(i).Get(colName).(haystack.Str); ok {
+			strs = append(strs, str.String())
+		}
+	}
+	return strs
+}
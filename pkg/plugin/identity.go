@@ -0,0 +1,228 @@
+package plugin
+
+import (
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/NeedleInAJayStack/haystack/client"
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/grafana/grafana-plugin-sdk-go/backend/httpclient"
+	"github.com/grafana/grafana-plugin-sdk-go/backend/log"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// User clients that haven't been used for this long are closed
+const userClientIdleTimeout = 10 * time.Minute
+
+// clientFactory creates Haystack clients from the datasource settings
+type clientFactory struct {
+	urls              []string // The server URLs, in order of preference
+	username          string
+	password          string
+	auth              *headerAuth // nil if the Haystack handshake is used
+	forwardToken      bool        // If true, user clients authenticate using the Grafana user's OAuth token
+	httpClientOptions httpclient.Options
+}
+
+// newClient creates a Haystack client, without opening it. If identity is non-nil, the client makes its requests
+// on behalf of that user. If there are multiple URLs, the client fails over between them.
+func (factory clientFactory) newClient(identity *forwardedIdentity) (HaystackClient, error) {
+	httpClient, err := factory.newHttpClient(identity)
+	if err != nil {
+		return nil, err
+	}
+
+	clients := make([]HaystackClient, len(factory.urls))
+	for i, url := range factory.urls {
+		if factory.auth != nil || (identity != nil && factory.forwardToken) {
+			// Header-based auth skips the Haystack handshake and adds its headers to every request instead
+			clients[i] = headerAuthClient{
+				Client: client.NewClientFromHTTP(url, "", "", httpClient),
+				auth:   factory.auth,
+			}
+		} else {
+			// The client is opened lazily, by Datasource.connect
+			clients[i] = client.NewClientFromHTTP(url, factory.username, factory.password, httpClient)
+		}
+	}
+	if len(clients) == 1 {
+		return clients[0], nil
+	}
+	return newFailoverClient(factory.urls, clients), nil
+}
+
+// newHttpClient creates the http client used for all of a Haystack client's requests, including the `Open`
+// handshake. It applies the settings from Grafana, like custom headers and the secure SOCKS proxy, followed by
+// the auth and identity headers.
+func (factory clientFactory) newHttpClient(identity *forwardedIdentity) (*http.Client, error) {
+	httpClientOptions := factory.httpClientOptions
+	middlewares := httpclient.DefaultMiddlewares()
+	if httpClientOptions.Middlewares != nil {
+		middlewares = append([]httpclient.Middleware{}, httpClientOptions.Middlewares...)
+	}
+	if factory.auth != nil {
+		middlewares = append(middlewares, factory.auth.middleware())
+	}
+	if identity != nil {
+		// Added after the auth so that the forwarded token replaces any configured credentials
+		middlewares = append(middlewares, identity.middleware())
+	}
+	httpClientOptions.Middlewares = middlewares
+	httpClient, err := httpclient.New(httpClientOptions)
+	if err != nil {
+		return nil, fmt.Errorf("new http client: %w", err)
+	}
+	return httpClient, nil
+}
+
+// forwardedIdentity adds the identity of a Grafana user to requests. The token is updated on every use,
+// since Grafana refreshes it independently of the plugin.
+type forwardedIdentity struct {
+	userHeader string // Empty if the login is not forwarded
+
+	mutex         sync.Mutex
+	login         string
+	authorization string // The `Authorization` header that Grafana received, or empty if the token is not forwarded
+}
+
+func (identity *forwardedIdentity) update(login string, authorization string) {
+	identity.mutex.Lock()
+	defer identity.mutex.Unlock()
+	identity.login = login
+	identity.authorization = authorization
+}
+
+// middleware returns an http client middleware that adds the user's login and token to every request
+func (identity *forwardedIdentity) middleware() httpclient.Middleware {
+	return httpclient.NamedMiddlewareFunc("haystack-forwarded-identity", func(opts httpclient.Options, next http.RoundTripper) http.RoundTripper {
+		return httpclient.RoundTripperFunc(func(req *http.Request) (*http.Response, error) {
+			identity.mutex.Lock()
+			login, authorization := identity.login, identity.authorization
+			identity.mutex.Unlock()
+
+			// RoundTrippers must not modify the request, so modify a copy
+			req = req.Clone(req.Context())
+			if identity.userHeader != "" {
+				req.Header.Set(identity.userHeader, login)
+			}
+			if authorization != "" {
+				req.Header.Set("Authorization", authorization)
+			}
+			return next.RoundTrip(req)
+		})
+	})
+}
+
+// userPool keeps a datasource for each Grafana user, each with its own Haystack client and caches.
+// Datasources that haven't been used recently are evicted.
+type userPool struct {
+	metrics      metricLabels // The instance's metric labels, shared by the users
+	newClient    func(identity *forwardedIdentity) (HaystackClient, error)
+	userHeader   string
+	forwardToken bool
+	idleTimeout  time.Duration
+	limiter      *requestLimiter  // The instance's request limits, shared by the users
+	treeRecords  prometheus.Gauge // Counts the records of the users' tree caches, or nil
+
+	mutex sync.Mutex
+	users map[string]*pooledUser
+}
+
+type pooledUser struct {
+	datasource *Datasource
+	identity   *forwardedIdentity
+	lastUsed   time.Time
+	inUse      int // The number of requests using the datasource. Datasources in use aren't evicted.
+}
+
+func newUserPool(metrics metricLabels, factory clientFactory, userHeader string, limiter *requestLimiter, treeRecords prometheus.Gauge) *userPool {
+	return &userPool{
+		metrics:      metrics,
+		limiter:      limiter,
+		treeRecords:  treeRecords,
+		newClient:    factory.newClient,
+		userHeader:   userHeader,
+		forwardToken: factory.forwardToken,
+		idleTimeout:  userClientIdleTimeout,
+		users:        map[string]*pooledUser{},
+	}
+}
+
+// forUser returns the datasource that makes requests on behalf of the user, and a function that must be called
+// once the request is done with it. authorization is the `Authorization` header of the Grafana request, which
+// contains the user's OAuth token if Grafana is configured to forward it.
+//
+// Requests without a user, like alerting and recorded queries, use the shared datasource and its configured
+// credentials. Requests from a user without an OAuth token are rejected when OAuth identity forwarding is enabled,
+// rather than being made with the configured credentials.
+func (datasource *Datasource) forUser(user *backend.User, authorization string) (*Datasource, func(), error) {
+	if datasource.users == nil || user == nil || user.Login == "" {
+		return datasource, func() {}, nil
+	}
+	if datasource.users.forwardToken && authorization == "" {
+		return nil, nil, fmt.Errorf("OAuth identity forwarding is enabled, but the request has no OAuth token")
+	}
+	return datasource.users.get(user.Login, authorization, time.Now())
+}
+
+// get returns the user's datasource, creating it if needed, and a function that releases it once the request is
+// done with it
+func (pool *userPool) get(login string, authorization string, now time.Time) (*Datasource, func(), error) {
+	pool.mutex.Lock()
+	defer pool.mutex.Unlock()
+
+	pool.evictIdle(now)
+
+	user, ok := pool.users[login]
+	if !ok {
+		identity := &forwardedIdentity{userHeader: pool.userHeader}
+		identity.update(login, authorization)
+		client, err := pool.newClient(identity)
+		if err != nil {
+			return nil, nil, err
+		}
+		log.DefaultLogger.Debug("Created user client", "user", login)
+		user = &pooledUser{
+			datasource: &Datasource{metrics: pool.metrics, client: client, limiter: pool.limiter, treeCache: treeCache{records: pool.treeRecords}},
+			identity:   identity,
+		}
+		pool.users[login] = user
+	}
+	if pool.forwardToken {
+		user.identity.update(login, authorization)
+	}
+	user.lastUsed = now
+	user.inUse++
+	release := sync.OnceFunc(func() {
+		pool.mutex.Lock()
+		defer pool.mutex.Unlock()
+		user.inUse--
+	})
+	return user.datasource, release, nil
+}
+
+// evictIdle closes and removes the users that haven't been used within the idle timeout, and aren't serving a
+// request. The mutex must be held.
+func (pool *userPool) evictIdle(now time.Time) {
+	for login, user := range pool.users {
+		if user.inUse == 0 && now.Sub(user.lastUsed) > pool.idleTimeout {
+			log.DefaultLogger.Debug("Evicting idle user client", "user", login)
+			user.datasource.close()
+			user.datasource.treeCache.forget()
+			delete(pool.users, login)
+		}
+	}
+}
+
+// close closes all user clients
+func (pool *userPool) close() {
+	pool.mutex.Lock()
+	defer pool.mutex.Unlock()
+	for login, user := range pool.users {
+		user.datasource.close()
+		user.datasource.treeCache.forget()
+		delete(pool.users, login)
+	}
+}
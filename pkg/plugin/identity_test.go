@@ -0,0 +1,212 @@
+package plugin
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/grafana/grafana-plugin-sdk-go/backend/httpclient"
+)
+
+func TestForwardedIdentity_Middleware(t *testing.T) {
+	var user, authorization string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user = r.Header.Get("X-Grafana-User")
+		authorization = r.Header.Get("Authorization")
+	}))
+	defer server.Close()
+
+	identity := &forwardedIdentity{userHeader: "X-Grafana-User"}
+	identity.update("jane", "Bearer first")
+	httpClient, err := httpclient.New(httpclient.Options{
+		Middlewares: []httpclient.Middleware{identity.middleware()},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, expected := range []string{"Bearer first", "Bearer refreshed"} {
+		identity.update("jane", expected)
+		req, _ := http.NewRequest("GET", server.URL, nil)
+		req.Header.Set("Authorization", "BEARER authToken=service")
+		resp, err := httpClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if user != "jane" {
+			t.Errorf("Expected user header 'jane', got %q", user)
+		}
+		if authorization != expected {
+			t.Errorf("Expected Authorization %q, got %q", expected, authorization)
+		}
+	}
+}
+
+func TestUserPool(t *testing.T) {
+	created := 0
+	pool := &userPool{
+		newClient: func(identity *forwardedIdentity) (HaystackClient, error) {
+			created++
+			return &testHaystackClient{}, nil
+		},
+		forwardToken: true,
+		idleTimeout:  time.Minute,
+		users:        map[string]*pooledUser{},
+	}
+	now := time.Now()
+
+	jane, releaseJane, err := pool.get("jane", "Bearer a", now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	releaseJane()
+	janeAgain, releaseJane, err := pool.get("jane", "Bearer b", now.Add(30*time.Second))
+	if err != nil {
+		t.Fatal(err)
+	}
+	releaseJane()
+	if jane != janeAgain || created != 1 {
+		t.Error("Expected the user's datasource to be reused")
+	}
+	if pool.users["jane"].identity.authorization != "Bearer b" {
+		t.Error("Expected the user's token to be updated")
+	}
+
+	_, releaseJohn, err := pool.get("john", "Bearer c", now.Add(time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if created != 2 || len(pool.users) != 2 {
+		t.Errorf("Expected 2 users, got %d", len(pool.users))
+	}
+
+	// jane was last used 2 minutes ago, and is evicted
+	_, releaseBob, err := pool.get("bob", "Bearer d", now.Add(150*time.Second))
+	if err != nil {
+		t.Fatal(err)
+	}
+	releaseBob()
+	if _, ok := pool.users["jane"]; ok || len(pool.users) != 2 {
+		t.Error("Expected the idle user to be evicted")
+	}
+
+	// john is still serving a request, so isn't evicted until it's released
+	_, releaseBob, err = pool.get("bob", "Bearer d", now.Add(200*time.Second))
+	if err != nil {
+		t.Fatal(err)
+	}
+	releaseBob()
+	if _, ok := pool.users["john"]; !ok {
+		t.Error("Expected the user in use not to be evicted")
+	}
+	releaseJohn()
+	releaseJohn() // Releasing more than once has no effect
+	_, releaseBob, err = pool.get("bob", "Bearer d", now.Add(200*time.Second))
+	if err != nil {
+		t.Fatal(err)
+	}
+	releaseBob()
+	if _, ok := pool.users["john"]; ok || len(pool.users) != 1 {
+		t.Error("Expected the released user to be evicted")
+	}
+}
+
+func TestForUser(t *testing.T) {
+	shared := &Datasource{client: &testHaystackClient{}}
+	result, release, err := shared.forUser(&backend.User{Login: "jane"}, "")
+	if err != nil || result != shared {
+		t.Error("Expected the shared datasource when the identity isn't forwarded")
+	}
+	release()
+
+	shared.users = &userPool{
+		newClient: func(identity *forwardedIdentity) (HaystackClient, error) {
+			return &testHaystackClient{}, nil
+		},
+		forwardToken: true,
+		idleTimeout:  time.Minute,
+		users:        map[string]*pooledUser{},
+	}
+	result, release, err = shared.forUser(&backend.User{Login: "jane"}, "Bearer a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	release()
+	if result == shared {
+		t.Error("Expected a user datasource")
+	}
+	_, _, err = shared.forUser(&backend.User{Login: "jane"}, "")
+	if err == nil {
+		t.Error("Expected an error when the user has no token to forward")
+	}
+
+	// Requests without a user, like alerting queries, use the shared datasource
+	result, release, err = shared.forUser(nil, "")
+	if err != nil || result != shared {
+		t.Error("Expected the shared datasource when the request has no user")
+	}
+	release()
+}
+
+func TestClientFactory_HttpClient(t *testing.T) {
+	var headers http.Header
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		headers = r.Header
+	}))
+	defer server.Close()
+
+	settings := backend.DataSourceInstanceSettings{
+		JSONData: []byte(`{
+			"authMode": "apiKey",
+			"httpHeaderName1": "X-Tenant-Id",
+			"httpHeaderName2": "X-Forwarded-For",
+			"enableSecureSocksProxy": true
+		}`),
+		DecryptedSecureJSONData: map[string]string{
+			"apiKey":           "secret",
+			"httpHeaderValue1": "acme",
+			"httpHeaderValue2": "10.0.0.1",
+		},
+	}
+	options := Options{AuthMode: authModeApiKey}
+	httpClientOptions, err := httpClientOptions(context.Background(), settings, options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if httpClientOptions.ProxyOptions == nil || !httpClientOptions.ProxyOptions.Enabled {
+		t.Error("Expected the secure SOCKS proxy to be enabled")
+	}
+
+	auth, err := newHeaderAuth(options, settings.DecryptedSecureJSONData, http.DefaultClient)
+	if err != nil {
+		t.Fatal(err)
+	}
+	factory := clientFactory{auth: auth, httpClientOptions: httpClientOptions}
+	identity := &forwardedIdentity{userHeader: "X-Grafana-User"}
+	identity.update("jane", "")
+	httpClient, err := factory.newHttpClient(identity)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	resp, err := httpClient.Get(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	expected := map[string]string{
+		"X-Tenant-Id":     "acme",
+		"X-Forwarded-For": "10.0.0.1",
+		"X-Api-Key":       "secret",
+		"X-Grafana-User":  "jane",
+	}
+	for name, value := range expected {
+		if headers.Get(name) != value {
+			t.Errorf("Expected header %s to be %q, got %q", name, value, headers.Get(name))
+		}
+	}
+}
@@ -0,0 +1,124 @@
+package plugin
+
+import (
+	"context"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// requestLimiter limits the rate and concurrency of the requests made by a datasource instance. The rate is
+// limited using a token bucket, and is shared by all queries and users of the instance. The haystack client's
+// requests don't carry the query's context, so the limits are acquired by the Datasource for each request,
+// rather than by the http client, so that requests of cancelled queries stop waiting and aren't made.
+type requestLimiter struct {
+	rate     float64
+	burst    float64
+	inFlight chan struct{} // A semaphore, or nil if concurrency is unlimited
+
+	// The instance's metrics. They're kept, rather than looked up for each request, so that requests that complete
+	// after the instance is disposed don't recreate its deleted series.
+	inFlightGauge prometheus.Gauge
+	waitHistogram prometheus.Observer
+
+	mutex  sync.Mutex
+	tokens float64
+	last   time.Time
+}
+
+// newRequestLimiter creates a limiter. A zero rate or maxInFlight is unlimited. If burst is zero, it defaults to
+// the number of requests allowed per second.
+func newRequestLimiter(metrics metricLabels, rate float64, burst int, maxInFlight int) *requestLimiter {
+	limiter := requestLimiter{
+		rate:          math.Max(rate, 0),
+		burst:         float64(burst),
+		last:          time.Now(),
+		inFlightGauge: limiterInFlight.WithLabelValues(metrics.values()...),
+		waitHistogram: limiterWait.WithLabelValues(metrics.values()...),
+	}
+	if limiter.burst <= 0 {
+		limiter.burst = math.Max(math.Ceil(limiter.rate), 1)
+	}
+	limiter.tokens = limiter.burst
+	if maxInFlight > 0 {
+		limiter.inFlight = make(chan struct{}, maxInFlight)
+	}
+
+	limiterRate.WithLabelValues(metrics.values()...).Set(limiter.rate)
+	limiterMaxInFlight.WithLabelValues(metrics.values()...).Set(float64(max(maxInFlight, 0)))
+	return &limiter
+}
+
+// acquire waits until the request is allowed by the rate limit and concurrency cap. The returned function must
+// be called when the request completes. A nil limiter allows every request.
+func (limiter *requestLimiter) acquire(ctx context.Context) (func(), error) {
+	if limiter == nil {
+		return func() {}, nil
+	}
+	start := time.Now()
+	err := limiter.waitForToken(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if limiter.inFlight != nil {
+		select {
+		case limiter.inFlight <- struct{}{}:
+		case <-ctx.Done():
+			// The request isn't made, so its token can be used by another
+			limiter.returnToken()
+			return nil, ctx.Err()
+		}
+	}
+	limiter.waitHistogram.Observe(time.Since(start).Seconds())
+	limiter.inFlightGauge.Inc()
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			limiter.inFlightGauge.Dec()
+			if limiter.inFlight != nil {
+				<-limiter.inFlight
+			}
+		})
+	}, nil
+}
+
+// waitForToken reserves a token from the bucket, and waits until it is available
+func (limiter *requestLimiter) waitForToken(ctx context.Context) error {
+	if limiter.rate == 0 {
+		return nil
+	}
+
+	limiter.mutex.Lock()
+	now := time.Now()
+	limiter.tokens = math.Min(limiter.burst, limiter.tokens+now.Sub(limiter.last).Seconds()*limiter.rate)
+	limiter.last = now
+	limiter.tokens--
+	delay := time.Duration(-limiter.tokens / limiter.rate * float64(time.Second))
+	limiter.mutex.Unlock()
+
+	if delay <= 0 {
+		return nil
+	}
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		limiter.returnToken()
+		return ctx.Err()
+	}
+}
+
+// returnToken returns a token reserved by waitForToken to the bucket
+func (limiter *requestLimiter) returnToken() {
+	if limiter.rate == 0 {
+		return
+	}
+	limiter.mutex.Lock()
+	defer limiter.mutex.Unlock()
+	limiter.tokens++
+}
@@ -0,0 +1,134 @@
+package plugin
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/NeedleInAJayStack/haystack"
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+)
+
+func TestRequestLimiter_Rate(t *testing.T) {
+	metrics := newMetricLabels("test-rate")
+	limiter := newRequestLimiter(metrics, 20, 1, 0)
+	defer metrics.delete()
+
+	start := time.Now()
+	for range 3 {
+		release, err := limiter.acquire(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		release()
+	}
+	// The first request uses the burst, and the next two wait 50ms each
+	if elapsed := time.Since(start); elapsed < 90*time.Millisecond {
+		t.Errorf("Expected the requests to be rate limited, but they took %v", elapsed)
+	}
+}
+
+func TestRequestLimiter_Cancel(t *testing.T) {
+	var evals atomic.Int32
+	started := make(chan struct{})
+	release := make(chan struct{})
+	client := &testHaystackClient{
+		evalFunc: func(expr string) (haystack.Grid, error) {
+			if evals.Add(1) == 1 {
+				close(started)
+				<-release
+			}
+			return haystack.EmptyGrid(), nil
+		},
+	}
+	// The burst allows the Open handshake, and the first two queries
+	metrics := newMetricLabels("test-cancel")
+	ds := Datasource{client: client, limiter: newRequestLimiter(metrics, 1, 3, 1)}
+	defer metrics.delete()
+	query := func(ctx context.Context, refID string) backend.DataResponse {
+		rawJson, err := json.Marshal(QueryModel{Type: "eval", Eval: "now()"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, err := ds.QueryData(ctx, &backend.QueryDataRequest{Queries: []backend.DataQuery{{RefID: refID, JSON: rawJson}}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp.Responses[refID]
+	}
+
+	// The first query holds the only request slot
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		query(context.Background(), "A")
+	}()
+	<-started
+
+	// The second query gets a token, but is cancelled while waiting for the slot
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if response := query(ctx, "B"); response.Status != backend.StatusTimeout {
+		t.Errorf("Expected the query to be cancelled, got %v: %v", response.Status, response.Error)
+	}
+	close(release)
+	<-done
+	// Give the cancelled query's goroutine time to make its request, if it were going to
+	time.Sleep(20 * time.Millisecond)
+	if evals.Load() != 1 {
+		t.Errorf("Expected the cancelled query not to make its request, got %d requests", evals.Load())
+	}
+
+	// Its token was returned, so the next query doesn't wait for the bucket to refill
+	start := time.Now()
+	if response := query(context.Background(), "C"); response.Error != nil {
+		t.Fatal(response.Error)
+	}
+	if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+		t.Errorf("Expected the cancelled query's token to be returned, but waited %v", elapsed)
+	}
+}
+
+func TestRequestLimiter_MaxInFlight(t *testing.T) {
+	var inFlight, maxInFlight atomic.Int32
+	client := &testHaystackClient{
+		evalFunc: func(expr string) (haystack.Grid, error) {
+			current := inFlight.Add(1)
+			defer inFlight.Add(-1)
+			for {
+				seen := maxInFlight.Load()
+				if current <= seen || maxInFlight.CompareAndSwap(seen, current) {
+					break
+				}
+			}
+			time.Sleep(20 * time.Millisecond)
+			return haystack.EmptyGrid(), nil
+		},
+	}
+	metrics := newMetricLabels("test-in-flight")
+	ds := Datasource{client: client, limiter: newRequestLimiter(metrics, 0, 0, 2)}
+	defer metrics.delete()
+
+	rawJson, err := json.Marshal(QueryModel{Type: "eval", Eval: "now()"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	queries := []backend.DataQuery{}
+	for i := range 6 {
+		queries = append(queries, backend.DataQuery{RefID: fmt.Sprintf("%c", 'A'+i), JSON: rawJson})
+	}
+	_, err = ds.QueryData(context.Background(), &backend.QueryDataRequest{Queries: queries})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if maxInFlight.Load() != 2 {
+		t.Errorf("Expected at most 2 requests in flight, got %d", maxInFlight.Load())
+	}
+	if len(ds.limiter.inFlight) != 0 {
+		t.Errorf("Expected all requests to be released, but %d are in flight", len(ds.limiter.inFlight))
+	}
+}
@@ -0,0 +1,93 @@
+package plugin
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/grafana/grafana-plugin-sdk-go/data"
+)
+
+// queryMeta describes what a query ran, and is added to the FrameMeta of the frames in its response
+type queryMeta struct {
+	executed      string         // The interpolated filter, Axon expression, or id that was sent to the server
+	frameType     data.FrameType // The type of the frames, or empty to detect it from their fields
+	visualization data.VisType   // The preferred visualization, or empty to detect it from the fields
+}
+
+// apply sets the FrameMeta of the response's frames, including the stats of the server requests
+func (meta queryMeta) apply(response backend.DataResponse, stats *queryStats) {
+	requestTime, requests := stats.get()
+	for _, frame := range response.Frames {
+		if frame.Meta == nil {
+			frame.Meta = &data.FrameMeta{}
+		}
+		frame.Meta.ExecutedQueryString = meta.executed
+		frame.Meta.Type = meta.frameType
+		frame.Meta.PreferredVisualization = meta.visualization
+		if meta.frameType == data.FrameTypeUnknown {
+			frame.Meta.Type, frame.Meta.PreferredVisualization = detectFrameType(frame)
+		}
+		frame.Meta.Stats = append(
+			frame.Meta.Stats,
+			data.QueryStat{FieldConfig: data.FieldConfig{DisplayName: "Rows"}, Value: float64(frame.Rows())},
+			data.QueryStat{FieldConfig: data.FieldConfig{DisplayName: "Server requests"}, Value: float64(requests)},
+			data.QueryStat{FieldConfig: data.FieldConfig{DisplayName: "Server request time", Unit: "ms"}, Value: float64(requestTime.Milliseconds())},
+		)
+	}
+}
+
+// detectFrameType returns the time series type of the frame, or a table if it isn't a time series
+func detectFrameType(frame *data.Frame) (data.FrameType, data.VisType) {
+	switch frame.TimeSeriesSchema().Type {
+	case data.TimeSeriesTypeWide:
+		return data.FrameTypeTimeSeriesWide, data.VisTypeGraph
+	case data.TimeSeriesTypeLong:
+		return data.FrameTypeTimeSeriesLong, data.VisTypeGraph
+	default:
+		return data.FrameTypeTable, data.VisTypeTable
+	}
+}
+
+type queryStatsKey struct{}
+
+// queryStats accumulates the server requests made by a query, including retries. The request time is the total
+// time of the requests, so it exceeds the query's duration when requests are made concurrently.
+type queryStats struct {
+	mutex       sync.Mutex
+	requestTime time.Duration
+	requests    int
+}
+
+// withQueryStats returns a context that accumulates the stats of the requests made with it
+func withQueryStats(ctx context.Context) (context.Context, *queryStats) {
+	stats := &queryStats{}
+	return context.WithValue(ctx, queryStatsKey{}, stats), stats
+}
+
+// queryStatsFromContext returns the stats of the context, or nil if it isn't accumulating them
+func queryStatsFromContext(ctx context.Context) *queryStats {
+	stats, _ := ctx.Value(queryStatsKey{}).(*queryStats)
+	return stats
+}
+
+// add records a request. It is a no-op on nil stats.
+func (stats *queryStats) add(requestTime time.Duration) {
+	if stats == nil {
+		return
+	}
+	stats.mutex.Lock()
+	defer stats.mutex.Unlock()
+	stats.requestTime += requestTime
+	stats.requests++
+}
+
+func (stats *queryStats) get() (time.Duration, int) {
+	if stats == nil {
+		return 0, 0
+	}
+	stats.mutex.Lock()
+	defer stats.mutex.Unlock()
+	return stats.requestTime, stats.requests
+}
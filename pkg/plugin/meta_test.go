@@ -0,0 +1,88 @@
+package plugin
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/NeedleInAJayStack/haystack"
+	"github.com/google/go-cmp/cmp"
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/grafana/grafana-plugin-sdk-go/data"
+)
+
+func TestQueryData_Meta(t *testing.T) {
+	evalResponse := haystack.NewGridBuilder()
+	evalResponse.AddCol("ts", map[string]haystack.Val{})
+	evalResponse.AddCol("v0", map[string]haystack.Val{})
+	evalResponse.AddRow([]haystack.Val{haystack.NewDateTimeFromGo(time.Unix(0, 0)), haystack.NewNumber(5, "kWh")})
+	evalResponse.AddRow([]haystack.Val{haystack.NewDateTimeFromGo(time.Unix(60, 0)), haystack.NewNumber(6, "kWh")})
+
+	readResponse := haystack.NewGridBuilder()
+	readResponse.AddCol("id", map[string]haystack.Val{})
+	readResponse.AddCol("dis", map[string]haystack.Val{})
+	readResponse.AddRow([]haystack.Val{haystack.NewRef("abc", ""), haystack.NewStr("Site")})
+
+	client := &testHaystackClient{
+		evalResponse: evalResponse.ToGrid(),
+		readResponse: readResponse.ToGrid(),
+	}
+	ds := Datasource{client: client}
+
+	queries := map[string]QueryModel{
+		"eval": {Type: "eval", Eval: "read(point).hisRead(today).take($__maxDataPoints)"},
+		"read": {Type: "read", Read: "site"},
+	}
+	req := &backend.QueryDataRequest{}
+	for refID, model := range queries {
+		rawJson, err := json.Marshal(model)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Queries = append(req.Queries, backend.DataQuery{
+			RefID:         refID,
+			JSON:          rawJson,
+			MaxDataPoints: 100,
+		})
+	}
+	resp, err := ds.QueryData(context.Background(), req)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := map[string]*data.FrameMeta{
+		"eval": {
+			Type:                   data.FrameTypeTimeSeriesWide,
+			PreferredVisualization: data.VisTypeGraph,
+			ExecutedQueryString:    "read(point).hisRead(today).take(100)",
+			Stats: []data.QueryStat{
+				{FieldConfig: data.FieldConfig{DisplayName: "Rows"}, Value: 2},
+				{FieldConfig: data.FieldConfig{DisplayName: "Server requests"}, Value: 1},
+				{FieldConfig: data.FieldConfig{DisplayName: "Server request time", Unit: "ms"}},
+			},
+		},
+		"read": {
+			Type:                   data.FrameTypeTable,
+			PreferredVisualization: data.VisTypeTable,
+			ExecutedQueryString:    "site",
+			Stats: []data.QueryStat{
+				{FieldConfig: data.FieldConfig{DisplayName: "Rows"}, Value: 1},
+				{FieldConfig: data.FieldConfig{DisplayName: "Server requests"}, Value: 1},
+				{FieldConfig: data.FieldConfig{DisplayName: "Server request time", Unit: "ms"}},
+			},
+		},
+	}
+	for refID, expectedMeta := range expected {
+		response := resp.Responses[refID]
+		if response.Error != nil {
+			t.Fatalf("%s: %v", refID, response.Error)
+		}
+		meta := response.Frames[0].Meta
+		// The request time against the mock is effectively instant
+		meta.Stats[2].Value = 0
+		if !cmp.Equal(meta, expectedMeta) {
+			t.Errorf("%s: %s", refID, cmp.Diff(meta, expectedMeta))
+		}
+	}
+}
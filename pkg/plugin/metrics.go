@@ -0,0 +1,140 @@
+package plugin
+
+import (
+	"errors"
+	"net/url"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/NeedleInAJayStack/haystack"
+	"github.com/NeedleInAJayStack/haystack/client"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// Plugin metrics, served by the SDK's metrics endpoint. All are labelled with the datasource UID and instance.
+var (
+	limiterRate = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "grafana_plugin",
+		Subsystem: "haystack",
+		Name:      "rate_limit_requests_per_second",
+		Help:      "The configured maximum rate of requests to the Haystack server. Zero if unlimited.",
+	}, []string{"datasource", "datasource_instance"})
+	limiterMaxInFlight = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "grafana_plugin",
+		Subsystem: "haystack",
+		Name:      "max_concurrent_requests",
+		Help:      "The configured maximum number of concurrent requests to the Haystack server. Zero if unlimited.",
+	}, []string{"datasource", "datasource_instance"})
+	limiterInFlight = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "grafana_plugin",
+		Subsystem: "haystack",
+		Name:      "requests_in_flight",
+		Help:      "The number of requests to the Haystack server that are in progress.",
+	}, []string{"datasource", "datasource_instance"})
+	limiterWait = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "grafana_plugin",
+		Subsystem: "haystack",
+		Name:      "request_limit_wait_seconds",
+		Help:      "The time requests to the Haystack server waited for the rate limit and concurrency cap.",
+		Buckets:   []float64{0.001, 0.01, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30},
+	}, []string{"datasource", "datasource_instance"})
+
+	requests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "grafana_plugin",
+		Subsystem: "haystack",
+		Name:      "requests_total",
+		Help:      "The number of Haystack op calls, including retries.",
+	}, []string{"datasource", "datasource_instance", "op"})
+	requestDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "grafana_plugin",
+		Subsystem: "haystack",
+		Name:      "request_duration_seconds",
+		Help:      "The latency of Haystack op calls.",
+		Buckets:   []float64{0.01, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60},
+	}, []string{"datasource", "datasource_instance", "op"})
+	requestErrors = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "grafana_plugin",
+		Subsystem: "haystack",
+		Name:      "request_errors_total",
+		Help:      "The number of failed Haystack op calls, by HTTP status code, or `connection` or `other` if there was no response.",
+	}, []string{"datasource", "datasource_instance", "op", "code"})
+	reauthentications = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "grafana_plugin",
+		Subsystem: "haystack",
+		Name:      "reauthentications_total",
+		Help:      "The number of times the client re-authenticated after a 403 or 404 response.",
+	}, []string{"datasource", "datasource_instance"})
+	hisReadFilterPoints = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "grafana_plugin",
+		Subsystem: "haystack",
+		Name:      "his_read_filter_points",
+		Help:      "The number of points read by each hisReadFilter query.",
+		Buckets:   []float64{1, 5, 10, 25, 50, 100, 200, 300},
+	}, []string{"datasource", "datasource_instance"})
+	treeCacheRecords = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "grafana_plugin",
+		Subsystem: "haystack",
+		Name:      "tree_cache_records",
+		Help:      "The number of records in the tree caches, including the cache of each user whose identity is forwarded.",
+	}, []string{"datasource", "datasource_instance"})
+)
+
+// observe returns the operation, wrapped to record its request count, latency, and errors
+func (datasource *Datasource) observe(op string, operation func() (haystack.Grid, error)) func() (haystack.Grid, error) {
+	return func() (haystack.Grid, error) {
+		start := time.Now()
+		result, err := operation()
+		requests.WithLabelValues(datasource.metrics.values(op)...).Inc()
+		requestDuration.WithLabelValues(datasource.metrics.values(op)...).Observe(time.Since(start).Seconds())
+		if err != nil {
+			requestErrors.WithLabelValues(datasource.metrics.values(op, errorCode(err))...).Inc()
+		}
+		return result, err
+	}
+}
+
+// errorCode returns the HTTP status code of the error, or `connection` or `other` if there was no response
+func errorCode(err error) string {
+	var httpErr client.HTTPError
+	if errors.As(err, &httpErr) {
+		return strconv.Itoa(httpErr.Code)
+	}
+	var urlErr *url.Error
+	if errors.As(err, &urlErr) {
+		return "connection"
+	}
+	return "other"
+}
+
+// metricLabels identifies the datasource instance that recorded a metric. When the settings are saved, the SDK
+// creates a new instance and disposes the old one a few seconds later, so each instance has its own series, and
+// disposing an instance deletes only its own.
+type metricLabels struct {
+	datasource string // The datasource UID
+	instance   string // Unique to the instance within the plugin process
+}
+
+var metricInstances atomic.Int64
+
+// newMetricLabels returns the labels of a new instance of the datasource
+func newMetricLabels(uid string) metricLabels {
+	return metricLabels{datasource: uid, instance: strconv.FormatInt(metricInstances.Add(1), 10)}
+}
+
+// values returns the label values, followed by the values of any additional labels
+func (labels metricLabels) values(extra ...string) []string {
+	return append([]string{labels.datasource, labels.instance}, extra...)
+}
+
+// delete removes the metrics of the instance, so that disposed instances aren't reported
+func (labels metricLabels) delete() {
+	match := prometheus.Labels{"datasource": labels.datasource, "datasource_instance": labels.instance}
+	for _, vec := range []interface{ DeletePartialMatch(prometheus.Labels) int }{
+		limiterRate, limiterMaxInFlight, limiterInFlight, limiterWait,
+		requests, requestDuration, requestErrors, reauthentications, hisReadFilterPoints, treeCacheRecords,
+	} {
+		vec.DeletePartialMatch(match)
+	}
+}
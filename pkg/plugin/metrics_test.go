@@ -0,0 +1,148 @@
+package plugin
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/NeedleInAJayStack/haystack"
+	haystackClient "github.com/NeedleInAJayStack/haystack/client"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestMetrics(t *testing.T) {
+	client := &testHaystackClient{
+		evalResponse: haystack.EmptyGrid(),
+		evalErrs: []error{
+			haystackClient.HTTPError{Code: 403, Msg: "Forbidden"},
+			haystackClient.HTTPError{Code: 400, Msg: "Bad Request"},
+		},
+	}
+	ds := Datasource{metrics: newMetricLabels("test-metrics"), client: client}
+	defer ds.metrics.delete()
+
+	// Fails with a 403, re-authenticates, then fails with a 400
+	_, err := ds.eval(context.Background(), "readAll(", map[string]string{})
+	if err == nil {
+		t.Fatal("Expected an error")
+	}
+	_, err = ds.eval(context.Background(), "readAll(site)", map[string]string{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if count := testutil.ToFloat64(requests.WithLabelValues(ds.metrics.values("eval")...)); count != 3 {
+		t.Errorf("Expected 3 eval requests, got %v", count)
+	}
+	if count := testutil.ToFloat64(requestErrors.WithLabelValues(ds.metrics.values("eval", "403")...)); count != 1 {
+		t.Errorf("Expected 1 403 error, got %v", count)
+	}
+	if count := testutil.ToFloat64(requestErrors.WithLabelValues(ds.metrics.values("eval", "400")...)); count != 1 {
+		t.Errorf("Expected 1 400 error, got %v", count)
+	}
+	if count := testutil.ToFloat64(reauthentications.WithLabelValues(ds.metrics.values()...)); count != 1 {
+		t.Errorf("Expected 1 re-authentication, got %v", count)
+	}
+	if count := testutil.CollectAndCount(requestDuration); count < 1 {
+		t.Errorf("Expected eval latency to be recorded")
+	}
+
+	ds.metrics.delete()
+	if requests.DeleteLabelValues(ds.metrics.values("eval")...) {
+		t.Errorf("Expected the metrics to be deleted")
+	}
+}
+
+func TestMetrics_Dispose(t *testing.T) {
+	// When the settings are saved, the old instance is disposed after the new one is created
+	old := Datasource{
+		metrics: newMetricLabels("test-dispose"),
+		client:  &testHaystackClient{evalResponse: haystack.EmptyGrid()},
+	}
+	old.limiter = newRequestLimiter(old.metrics, 10, 0, 4)
+	current := Datasource{
+		metrics: newMetricLabels("test-dispose"),
+		client:  &testHaystackClient{evalResponse: haystack.EmptyGrid()},
+	}
+	current.limiter = newRequestLimiter(current.metrics, 20, 0, 8)
+	defer current.metrics.delete()
+
+	release, err := old.limiter.acquire(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = current.eval(context.Background(), "readAll(site)", map[string]string{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	old.Dispose()
+	// A request that completes after the instance is disposed doesn't recreate its series
+	release()
+
+	if count := testutil.ToFloat64(limiterRate.WithLabelValues(current.metrics.values()...)); count != 20 {
+		t.Errorf("Expected the current instance's rate limit of 20, got %v", count)
+	}
+	if count := testutil.ToFloat64(limiterMaxInFlight.WithLabelValues(current.metrics.values()...)); count != 8 {
+		t.Errorf("Expected the current instance's concurrency cap of 8, got %v", count)
+	}
+	if count := testutil.ToFloat64(requests.WithLabelValues(current.metrics.values("eval")...)); count != 1 {
+		t.Errorf("Expected the current instance's eval request, got %v", count)
+	}
+	if limiterInFlight.DeleteLabelValues(old.metrics.values()...) {
+		t.Errorf("Expected the disposed instance's in flight requests not to be reported")
+	}
+}
+
+func TestTreeCacheRecords(t *testing.T) {
+	records := treeRecords()
+	metrics := newMetricLabels("test-tree-metrics")
+	gauge := treeCacheRecords.WithLabelValues(metrics.values()...)
+	defer metrics.delete()
+
+	// The shared and user datasources each add their records to the gauge
+	shared := Datasource{client: &testHaystackClient{readRecords: &records}, treeCache: treeCache{records: gauge}}
+	user := Datasource{client: &testHaystackClient{readRecords: &records}, treeCache: treeCache{records: gauge}}
+	nodes, err := shared.treeNodes(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = user.treeNodes(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count := testutil.ToFloat64(gauge); count != float64(2*len(nodes)) {
+		t.Errorf("Expected %d records, got %v", 2*len(nodes), count)
+	}
+
+	// A rebuild replaces the cache's records
+	shared.treeCache.builtAt = time.Now().Add(-2 * treeRebuildInterval)
+	_, err = shared.treeNodes(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count := testutil.ToFloat64(gauge); count != float64(2*len(nodes)) {
+		t.Errorf("Expected %d records after a rebuild, got %v", 2*len(nodes), count)
+	}
+
+	// An evicted user's records are removed
+	user.treeCache.forget()
+	if count := testutil.ToFloat64(gauge); count != float64(len(nodes)) {
+		t.Errorf("Expected %d records after eviction, got %v", len(nodes), count)
+	}
+}
+
+func TestErrorCode(t *testing.T) {
+	tests := map[error]string{
+		haystackClient.HTTPError{Code: 500, Msg: "Internal Server Error"}:                       "500",
+		fmt.Errorf("haystack client opening: %w", haystackClient.HTTPError{Code: 401, Msg: ""}): "401",
+		&url.Error{Op: "Get", URL: "http://localhost/api/about", Err: fmt.Errorf("refused")}:    "connection",
+		fmt.Errorf("id is not a Ref"): "other",
+	}
+	for err, expected := range tests {
+		if actual := errorCode(err); actual != expected {
+			t.Errorf("%v: expected %s, got %s", err, expected, actual)
+		}
+	}
+}
@@ -0,0 +1,126 @@
+package plugin
+
+import (
+	"context"
+
+	"github.com/NeedleInAJayStack/haystack"
+	"github.com/grafana/grafana-plugin-sdk-go/data"
+)
+
+// sites reads the sites matching the filter, and the records matching the status filter, if provided.
+// An empty site filter reads all sites.
+func (datasource *Datasource) sites(ctx context.Context, filter string, statusFilter string, variables map[string]string) (haystack.Grid, *haystack.Grid, error) {
+	if filter == "" {
+		filter = "site"
+	}
+	sites, err := datasource.read(ctx, filter, variables)
+	if err != nil {
+		return haystack.EmptyGrid(), nil, err
+	}
+	if statusFilter == "" {
+		return sites, nil, nil
+	}
+	status, err := datasource.read(ctx, statusFilter, variables)
+	if err != nil {
+		return haystack.EmptyGrid(), nil, err
+	}
+	return sites, &status, nil
+}
+
+// sitesFrameFromGrid converts a grid of site records to a frame that can be used by Grafana's Geomap panel.
+// The `latitude` and `longitude` fields are taken from the site's `geoCoord`. If a status grid is provided,
+// the `status` field is the number of status records that reference the site using `siteRef`.
+func sitesFrameFromGrid(sites haystack.Grid, status *haystack.Grid) *data.Frame {
+	statusCounts := map[string]float64{}
+	if status != nil {
+		for _, row := range status.Rows() {
+			if siteRef, ok := row.Get("siteRef").(haystack.Ref); ok {
+				statusCounts[siteRef.Id()] += 1
+			}
+		}
+	}
+
+	ids := []*string{}
+	dises := []*string{}
+	latitudes := []*float64{}
+	longitudes := []*float64{}
+	geoAddrs := []*string{}
+	geoCities := []*string{}
+	areas := []*float64{}
+	statuses := []*float64{}
+	areaUnit := ""
+	for _, row := range sites.Rows() {
+		var id *string
+		var dis *string
+		var siteStatus *float64
+		if ref, ok := row.Get("id").(haystack.Ref); ok {
+			idVal := ref.ToZinc()
+			id = &idVal
+			if ref.Dis() != "" {
+				disVal := ref.Dis()
+				dis = &disVal
+			}
+			if status != nil {
+				count := statusCounts[ref.Id()]
+				siteStatus = &count
+			}
+		}
+		if disVal, ok := row.Get("dis").(haystack.Str); ok {
+			value := disVal.String()
+			dis = &value
+		}
+
+		var latitude *float64
+		var longitude *float64
+		if coord, ok := row.Get("geoCoord").(haystack.Coord); ok {
+			lat := coord.Lat()
+			lng := coord.Lng()
+			latitude = &lat
+			longitude = &lng
+		}
+
+		var area *float64
+		if number, ok := row.Get("area").(haystack.Number); ok {
+			value := number.Float()
+			area = &value
+			if areaUnit == "" {
+				areaUnit = number.Unit()
+			}
+		}
+
+		ids = append(ids, id)
+		dises = append(dises, dis)
+		latitudes = append(latitudes, latitude)
+		longitudes = append(longitudes, longitude)
+		geoAddrs = append(geoAddrs, strFromRow(row, "geoAddr"))
+		geoCities = append(geoCities, strFromRow(row, "geoCity"))
+		areas = append(areas, area)
+		statuses = append(statuses, siteStatus)
+	}
+
+	fields := []*data.Field{
+		data.NewField("id", nil, ids),
+		data.NewField("dis", nil, dises),
+		data.NewField("latitude", nil, latitudes),
+		data.NewField("longitude", nil, longitudes),
+		data.NewField("geoAddr", nil, geoAddrs),
+		data.NewField("geoCity", nil, geoCities),
+		data.NewField("area", nil, areas).SetConfig(&data.FieldConfig{Unit: areaUnit}),
+	}
+	if status != nil {
+		fields = append(fields, data.NewField("status", nil, statuses))
+	}
+
+	frame := data.NewFrame("sites", fields...)
+	return frame
+}
+
+// strFromRow returns the value of the Str tag in the row, or nil if it is not a Str
+func strFromRow(row haystack.Row, name string) *string {
+	str, ok := row.Get(name).(haystack.Str)
+	if !ok {
+		return nil
+	}
+	value := str.String()
+	return &value
+}
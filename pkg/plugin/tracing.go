@@ -0,0 +1,51 @@
+package plugin
+
+import (
+	"context"
+
+	"github.com/NeedleInAJayStack/haystack"
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/grafana/grafana-plugin-sdk-go/backend/tracing"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Span attributes. Spans are exported to Grafana's tracing backend by the SDK, when tracing is enabled.
+const (
+	attributeQueries   = attribute.Key("haystack.queries")    // The number of queries in a QueryData request
+	attributeRefID     = attribute.Key("haystack.ref_id")     // The RefID of a query
+	attributeQueryType = attribute.Key("haystack.query_type") // The type of a query, like `eval` or `hisRead`
+	attributeOp        = attribute.Key("haystack.op")         // The Haystack op requested, like `eval` or `hisRead`
+	attributePointID   = attribute.Key("haystack.point_id")   // The id of a point read by a hisReadFilter query
+	attributeAttempts  = attribute.Key("haystack.attempts")   // The number of times an op was requested, including retries and failovers
+	attributeRows      = attribute.Key("haystack.rows")       // The number of rows in the op's grid, or the query's frames
+)
+
+// startSpan starts a span with the SDK's default tracer
+func startSpan(ctx context.Context, name string, attributes ...attribute.KeyValue) (context.Context, trace.Span) {
+	return tracing.DefaultTracer().Start(ctx, name, trace.WithAttributes(attributes...))
+}
+
+// endOpSpan records the result of a Haystack op on its span, and ends it
+func endOpSpan(span trace.Span, attempts int, result haystack.Grid, err error) {
+	span.SetAttributes(attributeAttempts.Int(attempts))
+	if err != nil {
+		tracing.Error(span, err)
+	} else {
+		span.SetAttributes(attributeRows.Int(result.RowCount()))
+	}
+	span.End()
+}
+
+// endQuerySpan records the result of a query on its span, and ends it
+func endQuerySpan(span trace.Span, response backend.DataResponse) {
+	rows := 0
+	for _, frame := range response.Frames {
+		rows += frame.Rows()
+	}
+	span.SetAttributes(attributeRows.Int(rows))
+	if response.Error != nil {
+		tracing.Error(span, response.Error)
+	}
+	span.End()
+}
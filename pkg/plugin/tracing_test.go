@@ -0,0 +1,119 @@
+package plugin
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/NeedleInAJayStack/haystack"
+	haystackClient "github.com/NeedleInAJayStack/haystack/client"
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/grafana/grafana-plugin-sdk-go/backend/tracing"
+	"go.opentelemetry.io/otel/attribute"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+func TestQueryData_Tracing(t *testing.T) {
+	recorder := tracetest.NewSpanRecorder()
+	previous := tracing.DefaultTracer()
+	tracing.InitDefaultTracer(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)).Tracer("test"))
+	defer tracing.InitDefaultTracer(previous)
+
+	points := haystack.NewGridBuilder()
+	points.AddCol("id", map[string]haystack.Val{})
+	points.AddCol("tz", map[string]haystack.Val{})
+	points.AddRow([]haystack.Val{haystack.NewRef("abcdefg-12345678", ""), haystack.NewStr("UTC")})
+
+	hisReadResponse := haystack.NewGridBuilder()
+	hisReadResponse.AddCol("ts", map[string]haystack.Val{})
+	hisReadResponse.AddCol("val", map[string]haystack.Val{})
+	hisReadResponse.AddRow([]haystack.Val{haystack.NewDateTimeFromGo(time.Unix(0, 0)), haystack.NewNumber(5, "kWh")})
+
+	evalResponse := haystack.NewGridBuilder()
+	evalResponse.AddCol("a", map[string]haystack.Val{})
+	evalResponse.AddRow([]haystack.Val{haystack.NewStr("a")})
+
+	client := &testHaystackClient{
+		readResponses:   map[string]haystack.Grid{"point and his": points.ToGrid()},
+		hisReadResponse: hisReadResponse.ToGrid(),
+		evalResponse:    evalResponse.ToGrid(),
+		evalErrs:        []error{haystackClient.HTTPError{Code: 403, Msg: "Forbidden"}},
+	}
+	ds := Datasource{client: client}
+
+	hisReadFilterJson, _ := json.Marshal(QueryModel{Type: "hisReadFilter", HisReadFilter: "point"})
+	evalJson, _ := json.Marshal(QueryModel{Type: "eval", Eval: "{a: \"a\"}"})
+	_, err := ds.QueryData(
+		context.Background(),
+		&backend.QueryDataRequest{
+			Queries: []backend.DataQuery{
+				{RefID: "A", JSON: hisReadFilterJson},
+				{RefID: "B", JSON: evalJson},
+			},
+		},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	spans := map[string]sdktrace.ReadOnlySpan{}
+	for _, span := range recorder.Ended() {
+		name := span.Name()
+		if name == "query" {
+			name += " " + attributeValue(span, attributeRefID).AsString()
+		}
+		spans[name] = span
+	}
+
+	expected := map[string]map[attribute.Key]attribute.Value{
+		"QueryData":           {attributeQueries: attribute.IntValue(2)},
+		"query A":             {attributeQueryType: attribute.StringValue("hisReadFilter"), attributeRows: attribute.IntValue(1)},
+		"query B":             {attributeQueryType: attribute.StringValue("eval"), attributeRows: attribute.IntValue(1)},
+		"hisReadFilter point": {attributePointID: attribute.StringValue("abcdefg-12345678")},
+		"haystack.read":       {attributeOp: attribute.StringValue("read"), attributeAttempts: attribute.IntValue(1), attributeRows: attribute.IntValue(1)},
+		"haystack.hisRead":    {attributeOp: attribute.StringValue("hisRead"), attributeAttempts: attribute.IntValue(1), attributeRows: attribute.IntValue(1)},
+		"haystack.eval":       {attributeOp: attribute.StringValue("eval"), attributeAttempts: attribute.IntValue(2), attributeRows: attribute.IntValue(1)},
+	}
+	for name, attributes := range expected {
+		span, ok := spans[name]
+		if !ok {
+			t.Errorf("Expected a %s span", name)
+			continue
+		}
+		for key, value := range attributes {
+			if actual := attributeValue(span, key); actual != value {
+				t.Errorf("%s: expected %s to be %v, got %v", name, key, value.Emit(), actual.Emit())
+			}
+		}
+	}
+
+	// Each span is a child of the span that caused it
+	parents := map[string]string{
+		"query A":             "QueryData",
+		"query B":             "QueryData",
+		"haystack.read":       "query A",
+		"hisReadFilter point": "query A",
+		"haystack.hisRead":    "hisReadFilter point",
+		"haystack.eval":       "query B",
+	}
+	for child, parent := range parents {
+		if spans[child] == nil || spans[parent] == nil {
+			continue
+		}
+		if spans[child].Parent().SpanID() != spans[parent].SpanContext().SpanID() {
+			t.Errorf("Expected %s to be a child of %s", child, parent)
+		}
+	}
+}
+
+// attributeValue returns the value of the span's attribute, or an empty value if it isn't set
+func attributeValue(span sdktrace.ReadOnlySpan, key attribute.Key) attribute.Value {
+	for _, attr := range span.Attributes() {
+		if attr.Key == key {
+			return attr.Value
+		}
+	}
+	return attribute.Value{}
+}
@@ -0,0 +1,338 @@
+package plugin
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/NeedleInAJayStack/haystack"
+	"github.com/NeedleInAJayStack/haystack-datasource/pkg/filter"
+	"github.com/grafana/grafana-plugin-sdk-go/data"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// The filter used to read all records in the navigation tree
+const treeFilter = "site or space or equip or point"
+
+// The tree is refreshed with the records modified since the last refresh once this interval has passed. This uses
+// an Axon `readAll`, since filters can't compare `mod` to a DateTime, so it is skipped if `eval` isn't available.
+// Records removed from the server are only dropped when the tree is fully rebuilt.
+const treeRefreshInterval = time.Minute
+const treeRebuildInterval = time.Hour
+
+// The maximum depth of the tree. This guards against Ref cycles.
+const treeMaxDepth = 32
+
+// The Ref tags that define a record's parent, in order of precedence. Sites are always roots.
+var treeParentTags = map[string][]string{
+	"space": {"spaceRef", "siteRef"},
+	"equip": {"equipRef", "spaceRef", "siteRef"},
+	"point": {"equipRef", "spaceRef", "siteRef"},
+}
+
+// treeNode is a record in the navigation tree
+type treeNode struct {
+	id       haystack.Ref
+	dis      string
+	kind     string // "site", "space", "equip", or "point"
+	parentId *haystack.Ref
+	record   haystack.Dict
+}
+
+// treeCache stores the navigation tree records, keyed by id, so that large hierarchies
+// don't need to be re-read on every query.
+type treeCache struct {
+	// Serializes the server reads, so that a rebuild or refresh is only made once. It isn't held by queries
+	// that can use the cached records while another query reads from the server.
+	loadMutex sync.Mutex
+
+	mutex       sync.Mutex // Guards the fields below
+	nodes       map[string]treeNode
+	lastMod     time.Time // The most recent `mod` of the cached records, or zero if they have none
+	canRefresh  bool      // Whether the server supports `eval`, which is needed to refresh the records
+	builtAt     time.Time
+	refreshedAt time.Time
+
+	// Counts the records of the instance's tree caches, which include a cache for each user whose identity is
+	// forwarded. Each cache adds the change in its own record count. Nil if the records aren't counted.
+	records  prometheus.Gauge
+	reported int // The number of records this cache has added to records
+}
+
+// treeNodes returns the cached tree records, rebuilding or refreshing the cache as needed. While another query
+// is reading from the server, the cached records are returned without waiting, unless there are none yet.
+func (datasource *Datasource) treeNodes(ctx context.Context) (map[string]treeNode, error) {
+	cache := &datasource.treeCache
+	if rebuild, refresh, _ := cache.due(time.Now()); rebuild || refresh {
+		if !cache.loadMutex.TryLock() {
+			if cache.populated() {
+				return cache.copyNodes(), nil
+			}
+			cache.loadMutex.Lock()
+		}
+		err := datasource.loadTree(ctx)
+		cache.loadMutex.Unlock()
+		if err != nil {
+			return nil, err
+		}
+	}
+	return cache.copyNodes(), nil
+}
+
+// loadTree rebuilds or refreshes the cache, if it is still due once the loadMutex is held. The cache mutex
+// isn't held during the server reads.
+func (datasource *Datasource) loadTree(ctx context.Context) error {
+	cache := &datasource.treeCache
+	now := time.Now()
+	rebuild, refresh, lastMod := cache.due(now)
+	if rebuild {
+		grid, err := datasource.read(ctx, treeFilter, map[string]string{})
+		if err != nil {
+			return err
+		}
+		canRefresh := false
+		ops, err := datasource.ops(ctx)
+		if err == nil {
+			canRefresh = hasOp(ops, "eval")
+		}
+
+		cache.mutex.Lock()
+		defer cache.mutex.Unlock()
+		cache.nodes = map[string]treeNode{}
+		cache.lastMod = time.Time{}
+		cache.addRecords(grid)
+		cache.canRefresh = canRefresh
+		cache.builtAt = now
+		cache.refreshedAt = now
+		cache.report()
+	} else if refresh {
+		// This may re-read the records modified at lastMod. That is fine since they are merged by id.
+		expr := fmt.Sprintf("readAll((%s) and mod >= %s)", treeFilter, haystack.NewDateTimeFromGo(lastMod.UTC()).ToAxon())
+		grid, err := datasource.eval(ctx, expr, map[string]string{})
+		if err != nil {
+			return err
+		}
+
+		cache.mutex.Lock()
+		defer cache.mutex.Unlock()
+		cache.addRecords(grid)
+		cache.refreshedAt = now
+		cache.report()
+	}
+	return nil
+}
+
+// due returns whether the cache should be rebuilt or refreshed, and the `mod` to refresh from. The cache is only
+// refreshed if the server supports `eval` and the records have a `mod`, and otherwise waits for the next rebuild.
+func (cache *treeCache) due(now time.Time) (rebuild bool, refresh bool, lastMod time.Time) {
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+	rebuild = cache.nodes == nil || now.Sub(cache.builtAt) > treeRebuildInterval
+	refresh = !rebuild && cache.canRefresh && !cache.lastMod.IsZero() && now.Sub(cache.refreshedAt) > treeRefreshInterval
+	return rebuild, refresh, cache.lastMod
+}
+
+// report adds the change in the number of cached records to the records gauge. The mutex must be held.
+func (cache *treeCache) report() {
+	if cache.records == nil {
+		return
+	}
+	cache.records.Add(float64(len(cache.nodes) - cache.reported))
+	cache.reported = len(cache.nodes)
+}
+
+// forget removes the cached records from the records gauge, when the cache is discarded
+func (cache *treeCache) forget() {
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+	if cache.records == nil {
+		return
+	}
+	cache.records.Sub(float64(cache.reported))
+	cache.reported = 0
+}
+
+func (cache *treeCache) populated() bool {
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+	return cache.nodes != nil
+}
+
+// copyNodes returns a copy of the cached records, so that callers aren't affected by later refreshes
+func (cache *treeCache) copyNodes() map[string]treeNode {
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+	nodes := make(map[string]treeNode, len(cache.nodes))
+	for id, node := range cache.nodes {
+		nodes[id] = node
+	}
+	return nodes
+}
+
+// addRecords adds or replaces the tree records in the grid
+func (cache *treeCache) addRecords(grid haystack.Grid) {
+	for _, row := range grid.Rows() {
+		id, ok := row.Get("id").(haystack.Ref)
+		if !ok {
+			continue
+		}
+		kind := ""
+		for _, tag := range []string{"site", "space", "equip", "point"} {
+			if _, isMarker := row.Get(tag).(haystack.Marker); isMarker {
+				kind = tag
+				break
+			}
+		}
+		if kind == "" {
+			continue
+		}
+
+		node := treeNode{id: id, kind: kind, record: dictFromRow(grid, row)}
+		if dis, ok := row.Get("dis").(haystack.Str); ok {
+			node.dis = dis.String()
+		} else if id.Dis() != "" {
+			node.dis = id.Dis()
+		} else {
+			node.dis = id.Id()
+		}
+		for _, tag := range treeParentTags[kind] {
+			if parentId, ok := row.Get(tag).(haystack.Ref); ok && parentId.Id() != id.Id() {
+				node.parentId = &parentId
+				break
+			}
+		}
+		cache.nodes[id.Id()] = node
+
+		if mod, ok := row.Get("mod").(haystack.DateTime); ok && mod.ToGo().After(cache.lastMod) {
+			cache.lastMod = mod.ToGo()
+		}
+	}
+}
+
+// filterTreeNodes returns the records that match the filter, along with their ancestors so that the hierarchy
+// is preserved. Ref paths in the filter are resolved using the tree records, so no server requests are made.
+func filterTreeNodes(nodes map[string]treeNode, node filter.Node) map[string]treeNode {
+	resolver := func(id haystack.Ref) (haystack.Dict, bool) {
+		treeNode, ok := nodes[id.Id()]
+		return treeNode.record, ok
+	}
+
+	filtered := map[string]treeNode{}
+	for id, treeNode := range nodes {
+		if !filter.Matches(node, treeNode.record, resolver) {
+			continue
+		}
+		filtered[id] = treeNode
+		current := treeNode
+		for depth := 0; current.parentId != nil && depth < treeMaxDepth; depth++ {
+			parent, ok := nodes[current.parentId.Id()]
+			if !ok {
+				break
+			}
+			filtered[parent.id.Id()] = parent
+			current = parent
+		}
+	}
+	return filtered
+}
+
+// dictFromRow returns the non-null values of the row as a Dict
+func dictFromRow(grid haystack.Grid, row haystack.Row) haystack.Dict {
+	items := map[string]haystack.Val{}
+	for _, col := range grid.Cols() {
+		val := row.Get(col.Name())
+		if val == nil {
+			continue
+		}
+		if _, isNull := val.(haystack.Null); isNull {
+			continue
+		}
+		items[col.Name()] = val
+	}
+	return haystack.NewDict(items)
+}
+
+// treeFrameFromNodes converts the tree records to a flat frame with `path`, `parentId`, `depth`, `id`, `dis`
+// and `kind` fields, sorted by path. If rootId is not empty, only the root and its descendants are included.
+// Records whose parent is not in the tree are treated as roots.
+func treeFrameFromNodes(nodes map[string]treeNode, rootId string) *data.Frame {
+	type treeRow struct {
+		node     treeNode
+		parentId *string
+		path     string
+		depth    int64
+	}
+
+	rows := []treeRow{}
+	for _, node := range nodes {
+		// Walk up the tree to compute the path
+		names := []string{node.dis}
+		inRoot := rootId == "" || node.id.Id() == rootId
+		var parentId *string
+		current := node
+		for current.parentId != nil && len(names) < treeMaxDepth {
+			parent, ok := nodes[current.parentId.Id()]
+			if !ok {
+				break
+			}
+			if parentId == nil {
+				parentIdVal := parent.id.ToZinc()
+				parentId = &parentIdVal
+			}
+			if parent.id.Id() == rootId {
+				inRoot = true
+			}
+			names = append(names, parent.dis)
+			current = parent
+		}
+		if !inRoot {
+			continue
+		}
+
+		// names are leaf-first, so reverse them
+		for i, j := 0, len(names)-1; i < j; i, j = i+1, j-1 {
+			names[i], names[j] = names[j], names[i]
+		}
+		rows = append(rows, treeRow{
+			node:     node,
+			parentId: parentId,
+			path:     "/" + strings.Join(names, "/"),
+			depth:    int64(len(names) - 1),
+		})
+	}
+
+	sort.Slice(rows, func(i, j int) bool {
+		if rows[i].path != rows[j].path {
+			return rows[i].path < rows[j].path
+		}
+		return rows[i].node.id.Id() < rows[j].node.id.Id()
+	})
+
+	paths := []string{}
+	parentIds := []*string{}
+	depths := []int64{}
+	ids := []string{}
+	dises := []string{}
+	kinds := []string{}
+	for _, row := range rows {
+		paths = append(paths, row.path)
+		parentIds = append(parentIds, row.parentId)
+		depths = append(depths, row.depth)
+		ids = append(ids, row.node.id.ToZinc())
+		dises = append(dises, row.node.dis)
+		kinds = append(kinds, row.node.kind)
+	}
+
+	frame := data.NewFrame("tree",
+		data.NewField("path", nil, paths),
+		data.NewField("parentId", nil, parentIds),
+		data.NewField("depth", nil, depths),
+		data.NewField("id", nil, ids),
+		data.NewField("dis", nil, dises),
+		data.NewField("kind", nil, kinds),
+	)
+	return frame
+}
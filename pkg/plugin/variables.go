@@ -0,0 +1,317 @@
+package plugin
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/NeedleInAJayStack/haystack"
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/grafana/grafana-plugin-sdk-go/backend/log"
+)
+
+// VariableRequest is the body of a `variables` resource request. The query strings are not interpolated by the
+// frontend. Instead, the raw values of the Grafana template variables are sent so that Ref and multi-select values
+// can be encoded correctly for the query type.
+type VariableRequest struct {
+	QueryModel
+	Column        string              `json:"column"`
+	DisplayColumn string              `json:"displayColumn"`
+	Variables     map[string][]string `json:"variables"` // The values of the Grafana template variables, by name
+	Range         struct {
+		From time.Time `json:"from"`
+		To   time.Time `json:"to"`
+	} `json:"range"`
+}
+
+// VariableValue is a single value of a variable query, in the format expected by Grafana's MetricFindValue
+type VariableValue struct {
+	Text  string `json:"text"`
+	Value string `json:"value"`
+}
+
+// handleVariables runs a variable query and responds with the variable values as `{text, value}` pairs.
+func (datasource *Datasource) handleVariables(writer http.ResponseWriter, request *http.Request) {
+	if request.Method != http.MethodPost {
+		http.Error(writer, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var variableRequest VariableRequest
+	err := json.NewDecoder(request.Body).Decode(&variableRequest)
+	if err != nil {
+		http.Error(writer, fmt.Sprintf("json unmarshal failure: %v", err.Error()), http.StatusBadRequest)
+		return
+	}
+
+	values, err := datasource.variableValues(request.Context(), variableRequest)
+	if err != nil {
+		log.DefaultLogger.Error(err.Error())
+		http.Error(writer, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	writer.Header().Set("Content-Type", "application/json")
+	err = json.NewEncoder(writer).Encode(values)
+	if err != nil {
+		log.DefaultLogger.Error(err.Error())
+	}
+}
+
+// variableValues runs the variable query and converts the result to variable values
+func (datasource *Datasource) variableValues(ctx context.Context, request VariableRequest) ([]VariableValue, error) {
+	variables := queryVariables(backend.DataQuery{
+		TimeRange: backend.TimeRange{From: request.Range.From, To: request.Range.To},
+	})
+
+	var grid haystack.Grid
+	var err error
+	switch request.Type {
+	case "read":
+		filter := interpolateFilter(request.Read, request.Variables)
+		grid, err = datasource.read(ctx, filter, variables)
+		if err != nil {
+			return nil, fmt.Errorf("read failure: %w", err)
+		}
+	case "eval":
+		expr := interpolateAxon(request.Eval, request.Variables)
+		grid, err = datasource.eval(ctx, expr, variables)
+		if err != nil {
+			return nil, fmt.Errorf("eval failure: %w", err)
+		}
+	case "nav":
+		grid, err = datasource.nav(ctx, request.Nav)
+		if err != nil {
+			return nil, fmt.Errorf("nav failure: %w", err)
+		}
+	default:
+		return nil, fmt.Errorf("invalid variable query type %s", request.Type)
+	}
+
+	return variableValuesFromGrid(grid, request.Column, request.DisplayColumn), nil
+}
+
+// variableValuesFromGrid returns the variable values from the grid column. If no column is given, `id` is used if
+// present, and otherwise the first column. If no display column is given, Ref values are displayed using the
+// record's `dis` tag or the Ref's display name.
+func variableValuesFromGrid(grid haystack.Grid, column string, displayColumn string) []VariableValue {
+	values := []VariableValue{}
+	if len(grid.Cols()) == 0 {
+		return values
+	}
+
+	if column == "" || !gridHasCol(grid, column) {
+		column = grid.Cols()[0].Name()
+		if gridHasCol(grid, "id") {
+			column = "id"
+		}
+	}
+	if displayColumn != "" && !gridHasCol(grid, displayColumn) {
+		displayColumn = ""
+	}
+
+	for _, row := range grid.Rows() {
+		val := row.Get(column)
+		if _, isNull := val.(haystack.Null); isNull {
+			continue
+		}
+
+		text := variableText(val)
+		if displayColumn != "" {
+			text = variableText(row.Get(displayColumn))
+		} else if _, isRef := val.(haystack.Ref); isRef {
+			if dis, ok := row.Get("dis").(haystack.Str); ok {
+				text = dis.String()
+			}
+		}
+		values = append(values, VariableValue{Text: text, Value: variableValue(val)})
+	}
+	return values
+}
+
+// variableValue returns the value injected by a variable. Refs only include the id, like `@abc`.
+func variableValue(val haystack.Val) string {
+	switch val := val.(type) {
+	case haystack.Ref:
+		return "@" + val.Id()
+	case haystack.Str:
+		return val.String()
+	default:
+		return val.ToZinc()
+	}
+}
+
+// variableText returns the display text of a variable value. Refs are displayed using their display name if present.
+func variableText(val haystack.Val) string {
+	switch val := val.(type) {
+	case haystack.Null:
+		return ""
+	case haystack.Ref:
+		if val.Dis() != "" {
+			return val.Dis()
+		}
+		return "@" + val.Id()
+	case haystack.Str:
+		return val.String()
+	default:
+		return val.ToZinc()
+	}
+}
+
+func gridHasCol(grid haystack.Grid, name string) bool {
+	for _, col := range grid.Cols() {
+		if col.Name() == name {
+			return true
+		}
+	}
+	return false
+}
+
+// A variable reference in any of Grafana's forms: `$name`, `${name}`, `${name:format}`, `[[name]]`, or
+// `[[name:format]]`. Submatches are the braced name and format, the plain name, and the bracketed name and format.
+const variableReference = `(?:\$\{(\w+)(?::(\w+))?\}|\$(\w+)|\[\[(\w+)(?::(\w+))?\]\])`
+
+// A comparison whose right side is a variable, like `siteRef==$site` or `dis=="${name}"`.
+// Submatches are the path, operator, opening quote, the variable reference submatches, and closing quote.
+var variableComparisonRegexp = regexp.MustCompile(`([a-zA-Z_]\w*(?:->[a-zA-Z_]\w*)*)\s*(==|!=)\s*("?)` + variableReference + `("?)`)
+
+// A variable reference, optionally surrounded by quotes, like `$site` or `"${name}"`.
+// Submatches are the opening quote, the variable reference submatches, and closing quote.
+var variableRegexp = regexp.MustCompile(`("?)` + variableReference + `("?)`)
+
+// A number that can be used as-is in filters and Axon, like `2` or `-1.5`
+var variableNumberRegexp = regexp.MustCompile(`^-?[0-9]+(\.[0-9]+)?$`)
+
+// interpolateFilter replaces the variables in a Haystack filter. Comparisons against multi-value variables are
+// expanded into an `or` of equality checks (or an `and` of inequality checks), and values are encoded as filter
+// literals. Unknown variables, including the built-in `$__` variables, are left unchanged.
+func interpolateFilter(filter string, variables map[string][]string) string {
+	filter = variableComparisonRegexp.ReplaceAllStringFunc(filter, func(match string) string {
+		submatches := variableComparisonRegexp.FindStringSubmatch(match)
+		path, op := submatches[1], submatches[2]
+		name, format, quoted := variableMatchName(submatches[3:])
+		values, ok := variables[name]
+		if !ok || len(values) == 0 || format != "" {
+			// Variables with an explicit format are replaced as written below
+			return match
+		}
+
+		clauses := []string{}
+		for _, value := range values {
+			clauses = append(clauses, path+op+encodeVariableValue(value, quoted))
+		}
+		if len(clauses) == 1 {
+			return clauses[0]
+		}
+		joiner := " or "
+		if op == "!=" {
+			joiner = " and "
+		}
+		return "(" + strings.Join(clauses, joiner) + ")"
+	})
+
+	return replaceVariables(filter, variables, func(values []string, quoted bool) string {
+		encoded := []string{}
+		for _, value := range values {
+			encoded = append(encoded, encodeVariableValue(value, quoted))
+		}
+		return strings.Join(encoded, ",")
+	})
+}
+
+// interpolateAxon replaces the variables in an Axon expression. Multi-value variables are encoded as an Axon list.
+// Unknown variables, including the built-in `$__` variables, are left unchanged.
+func interpolateAxon(expr string, variables map[string][]string) string {
+	return replaceVariables(expr, variables, func(values []string, quoted bool) string {
+		if len(values) == 1 {
+			return encodeVariableValue(values[0], quoted)
+		}
+		encoded := []string{}
+		for _, value := range values {
+			encoded = append(encoded, encodeVariableValue(value, quoted))
+		}
+		return "[" + strings.Join(encoded, ", ") + "]"
+	})
+}
+
+// replaceVariables replaces the known variables in the string using the encode function
+func replaceVariables(str string, variables map[string][]string, encode func(values []string, quoted bool) string) string {
+	return variableRegexp.ReplaceAllStringFunc(str, func(match string) string {
+		submatches := variableRegexp.FindStringSubmatch(match)
+		name, format, quoted := variableMatchName(submatches[1:])
+		values, ok := variables[name]
+		if !ok || len(values) == 0 {
+			return match
+		}
+		openQuote, closeQuote := submatches[1], submatches[len(submatches)-1]
+		if format != "" {
+			// The values are formatted as requested, without Haystack encoding, like Grafana does
+			return openQuote + formatVariableValues(values, format) + closeQuote
+		}
+		encoded := encode(values, quoted)
+		if !quoted {
+			// Keep any unbalanced quote that was matched
+			encoded = openQuote + encoded + closeQuote
+		}
+		return encoded
+	})
+}
+
+// variableMatchName returns the variable name and format from the regexp submatches, starting at the opening
+// quote, and whether the variable is surrounded by quotes
+func variableMatchName(submatches []string) (string, string, bool) {
+	openQuote, closeQuote := submatches[0], submatches[6]
+	name, format := submatches[1], submatches[2]
+	if submatches[3] != "" {
+		name = submatches[3]
+	}
+	if submatches[4] != "" {
+		name, format = submatches[4], submatches[5]
+	}
+	return name, format, openQuote != "" && closeQuote != ""
+}
+
+// formatVariableValues joins the values using one of Grafana's variable formats. Unsupported formats, like
+// `raw` and `csv`, join the values with commas.
+func formatVariableValues(values []string, format string) string {
+	switch format {
+	case "pipe":
+		return strings.Join(values, "|")
+	case "json":
+		encoded, err := json.Marshal(values)
+		if err != nil {
+			return strings.Join(values, ",")
+		}
+		return string(encoded)
+	case "singlequote":
+		return "'" + strings.Join(values, "','") + "'"
+	case "doublequote":
+		return "\"" + strings.Join(values, "\",\"") + "\""
+	default:
+		return strings.Join(values, ",")
+	}
+}
+
+// encodeVariableValue encodes a variable value as a Haystack literal. Quoted values are always encoded as a Str.
+// Otherwise, values starting with `@` are Refs (any display name is dropped), numbers and booleans are left as-is,
+// and everything else is encoded as a Str.
+func encodeVariableValue(value string, quoted bool) string {
+	if quoted {
+		return haystack.NewStr(value).ToZinc()
+	}
+	if strings.HasPrefix(value, "@") {
+		id, _, _ := strings.Cut(value, " ")
+		return id
+	}
+	if variableNumberRegexp.MatchString(value) {
+		return value
+	}
+	if value == "true" || value == "false" {
+		return value
+	}
+	return haystack.NewStr(value).ToZinc()
+}
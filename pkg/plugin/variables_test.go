@@ -0,0 +1,152 @@
+package plugin
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+
+	"github.com/NeedleInAJayStack/haystack"
+	"github.com/google/go-cmp/cmp"
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+)
+
+func TestInterpolateFilter(t *testing.T) {
+	variables := map[string][]string{
+		"site":  {"@site-1"},
+		"sites": {"@site-1 \"Site 1\"", "@site-2"},
+		"name":  {"AHU-1"},
+		"floor": {"2"},
+	}
+
+	tests := map[string]string{
+		"equip and siteRef==$site":           "equip and siteRef==@site-1",
+		"equip and siteRef==${sites}":        "equip and (siteRef==@site-1 or siteRef==@site-2)",
+		"equip and siteRef != $sites":        "equip and (siteRef!=@site-1 and siteRef!=@site-2)",
+		"equip and equipRef->siteRef==$site": "equip and equipRef->siteRef==@site-1",
+		"equip and dis==$name":               "equip and dis==\"AHU-1\"",
+		"equip and dis==\"$name\"":           "equip and dis==\"AHU-1\"",
+		"equip and floor==$floor":            "equip and floor==2",
+		"equip and siteRef==$unknown":        "equip and siteRef==$unknown",
+		"point and mod > $__timeRange_start": "point and mod > $__timeRange_start",
+		"equip and siteRef==[[site]]":        "equip and siteRef==@site-1",
+		"equip and siteRef==[[sites]]":       "equip and (siteRef==@site-1 or siteRef==@site-2)",
+		"equip and dis==\"[[name]]\"":        "equip and dis==\"AHU-1\"",
+		"equip and dis==\"${name:raw}\"":     "equip and dis==\"AHU-1\"",
+		"equip and floor==[[floor:raw]]":     "equip and floor==2",
+	}
+
+	for input, expected := range tests {
+		actual := interpolateFilter(input, variables)
+		if actual != expected {
+			t.Errorf("interpolateFilter(%q): expected %q, got %q", input, expected, actual)
+		}
+	}
+}
+
+func TestEncodeVariableValue(t *testing.T) {
+	tests := map[string]string{
+		"2":          "2",
+		"-1.5":       "-1.5",
+		"NaN":        "\"NaN\"",
+		"Inf":        "\"Inf\"",
+		"+1":         "\"+1\"",
+		"0x1p-2":     "\"0x1p-2\"",
+		"1e5":        "\"1e5\"",
+		"true":       "true",
+		"@abc":       "@abc",
+		"AHU-1":      "\"AHU-1\"",
+		"a\"b":       "\"a\\\"b\"",
+		"@abc \"A\"": "@abc",
+	}
+
+	for input, expected := range tests {
+		actual := encodeVariableValue(input, false)
+		if actual != expected {
+			t.Errorf("encodeVariableValue(%q): expected %q, got %q", input, expected, actual)
+		}
+	}
+}
+
+func TestInterpolateAxon(t *testing.T) {
+	variables := map[string][]string{
+		"site":  {"@site-1"},
+		"sites": {"@site-1", "@site-2"},
+		"name":  {"AHU-1"},
+	}
+
+	tests := map[string]string{
+		"readById($site)":                            "readById(@site-1)",
+		"readByIds($sites)":                          "readByIds([@site-1, @site-2])",
+		"read(equip and dis==\"$name\")":             "read(equip and dis==\"AHU-1\")",
+		"readAll(point).hisRead($__timeRange_start)": "readAll(point).hisRead($__timeRange_start)",
+		"readByIds([[sites]])":                       "readByIds([@site-1, @site-2])",
+		"[\"${sites:pipe}\"]":                        "[\"@site-1|@site-2\"]",
+		"${sites:json}":                              "[\"@site-1\",\"@site-2\"]",
+		"[${sites:doublequote}]":                     "[\"@site-1\",\"@site-2\"]",
+	}
+
+	for input, expected := range tests {
+		actual := interpolateAxon(input, variables)
+		if actual != expected {
+			t.Errorf("interpolateAxon(%q): expected %q, got %q", input, expected, actual)
+		}
+	}
+}
+
+func TestCallResource_Variables(t *testing.T) {
+	response := haystack.NewGridBuilder()
+	response.AddCol("id", map[string]haystack.Val{})
+	response.AddCol("dis", map[string]haystack.Val{})
+	response.AddRow([]haystack.Val{haystack.NewRef("equip-1", "Site 1 AHU-1"), haystack.NewStr("AHU-1")})
+	response.AddRow([]haystack.Val{haystack.NewRef("equip-2", "Site 2 AHU-2"), haystack.NewNull()})
+
+	client := &testHaystackClient{
+		readResponses: map[string]haystack.Grid{
+			"equip and (siteRef==@site-1 or siteRef==@site-2)": response.ToGrid(),
+		},
+	}
+	ds := Datasource{client: client}
+
+	body, err := json.Marshal(map[string]any{
+		"type":      "read",
+		"read":      "equip and siteRef==$site",
+		"variables": map[string][]string{"site": {"@site-1", "@site-2"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var resp *backend.CallResourceResponse
+	err = ds.CallResource(
+		context.Background(),
+		&backend.CallResourceRequest{
+			Method: "POST",
+			Path:   "variables",
+			URL:    "variables",
+			Body:   body,
+		},
+		backend.CallResourceResponseSenderFunc(func(r *backend.CallResourceResponse) error {
+			resp = r
+			return nil
+		}),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Status != 200 {
+		t.Fatalf("Resource call had non-OK status '%v': %s", resp.Status, resp.Body)
+	}
+
+	var actual []VariableValue
+	err = json.Unmarshal(resp.Body, &actual)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []VariableValue{
+		{Text: "AHU-1", Value: "@equip-1"},
+		{Text: "Site 2 AHU-2", Value: "@equip-2"},
+	}
+	if !cmp.Equal(actual, expected) {
+		t.Error(cmp.Diff(actual, expected))
+	}
+}
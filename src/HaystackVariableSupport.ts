@@ -8,7 +8,8 @@ import {
   MetricFindValue,
 } from '@grafana/data';
 
-import { Observable } from 'rxjs';
+import { getTemplateSrv } from '@grafana/runtime';
+import { from, Observable } from 'rxjs';
 import { map } from 'rxjs/operators';
 
 import { HaystackVariableQueryEditor } from './components/HaystackVariableQueryEditor';
@@ -25,6 +26,20 @@ export class HaystackVariableSupport extends CustomVariableSupport<DataSource, H
 
   query(request: DataQueryRequest<HaystackVariableQuery>): Observable<DataQueryResponse> {
     let variableQuery = request.targets[0];
+    if (resourceQueryTypes.includes(variableQuery.type ?? '')) {
+      // Interpolate on the backend so that Ref and multi-select values are encoded correctly
+      let body = {
+        ...variableQuery,
+        variables: templateVariableValues(),
+        range: { from: request.range.from.toISOString(), to: request.range.to.toISOString() },
+      };
+      return from(this.datasource.postResource<MetricFindValue[]>('variables', body)).pipe(
+        map((values) => {
+          return { data: values };
+        })
+      );
+    }
+
     let observable = this.datasource.query(request);
     return observable.pipe(
       map((response) => {
@@ -69,6 +84,31 @@ export class HaystackVariableSupport extends CustomVariableSupport<DataSource, H
   }
 }
 
+// Query types that are resolved by the backend `variables` resource
+const resourceQueryTypes = ['read', 'eval', 'nav'];
+
+// Returns the current values of the dashboard's template variables, by name
+function templateVariableValues(): Record<string, string[]> {
+  let values: Record<string, string[]> = {};
+  getTemplateSrv()
+    .getVariables()
+    .forEach((variable) => {
+      if (!('current' in variable) || variable.current?.value === undefined) {
+        return;
+      }
+      let value = variable.current.value;
+      let variableValues = Array.isArray(value) ? value : [value];
+      if (variableValues.includes('$__all') && 'options' in variable) {
+        variableValues = variable.options
+          .map((option) => option.value)
+          .flat()
+          .filter((optionValue) => optionValue !== '$__all');
+      }
+      values[variable.name] = variableValues;
+    });
+  return values;
+}
+
 function variableValueFromCell(value: string, columnType: FieldType): string {
   switch (columnType) {
     case FieldType.string:
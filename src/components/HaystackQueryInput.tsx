@@ -1,17 +1,59 @@
-import { AutoSizeInput, Icon, InlineField } from '@grafana/ui';
+import { AsyncSelect, AutoSizeInput, Icon, InlineField, Stack } from '@grafana/ui';
+import { SelectableValue } from '@grafana/data';
 import React, { ChangeEvent } from 'react';
 import { DEFAULT_QUERY, HaystackQuery } from 'types';
+import { DataSource } from '../datasource';
 
 export interface HaystackQueryInputProps {
+  datasource: DataSource | null;
   query: HaystackQuery;
   onChange: (query: string) => void;
 }
 
-export function HaystackQueryInput({ query, onChange }: HaystackQueryInputProps) {
+export function HaystackQueryInput({ datasource, query, onChange }: HaystackQueryInputProps) {
   const onQueryChange = (event: ChangeEvent<HTMLInputElement>) => {
     onChange(event.target.value);
   };
 
+  // A filter input, with a selector that adds one of the server's tags to the filter
+  const filterInput = (value: string | undefined, placeholder: string | undefined, tooltip?: string) => {
+    const onTagChange = (tag: SelectableValue<string>) => {
+      if (tag.value === undefined) {
+        return;
+      }
+      const filter = (value ?? '').trim();
+      onChange(filter === '' ? tag.value : `${filter} and ${tag.value}`);
+    };
+    return (
+      <Stack direction="row" gap={0}>
+        <InlineField tooltip={tooltip}>
+          <AutoSizeInput
+            minWidth={minWidth}
+            prefix={<Icon name="filter" />}
+            onBlur={onQueryChange}
+            value={value}
+            placeholder={placeholder}
+          />
+        </InlineField>
+        {datasource !== null && (
+          <InlineField>
+            <AsyncSelect
+              loadOptions={async (inputValue: string) => {
+                const tags = await datasource.loadTags(inputValue);
+                return tags.map((tag) => ({ label: tag.name, value: tag.name, description: tag.doc }));
+              }}
+              defaultOptions
+              value={null}
+              placeholder="Add tag"
+              width={20}
+              onChange={onTagChange}
+            />
+          </InlineField>
+        )}
+      </Stack>
+    );
+  };
+
   let minWidth = 50;
   switch (query.type) {
     case "eval":
@@ -39,29 +81,41 @@ export function HaystackQueryInput({ query, onChange }: HaystackQueryInputProps)
         </InlineField>
       );
     case "hisReadFilter":
+      return filterInput(query.hisReadFilter, DEFAULT_QUERY.hisReadFilter);
+    case "read":
+      return filterInput(query.read, DEFAULT_QUERY.read);
+    case "annotations":
       return (
         <InlineField>
           <AutoSizeInput
             minWidth={minWidth}
-            prefix={<Icon name="filter" />}
+            prefix={query.annotationsSource === "eval" ? <Icon name="angle-right" /> : <Icon name="filter" />}
             onBlur={onQueryChange}
-            value={query.hisReadFilter}
-            placeholder={DEFAULT_QUERY.hisReadFilter}
+            value={query.annotations}
+            placeholder={DEFAULT_QUERY.annotations}
           />
         </InlineField>
       );
-    case "read":
+    case "sites":
+      return filterInput(query.sites, DEFAULT_QUERY.sites);
+    case "tree":
       return (
-        <InlineField>
+        <InlineField tooltip="The id of the root record. Leave empty for the full tree">
           <AutoSizeInput
             minWidth={minWidth}
-            prefix={<Icon name="filter" />}
+            prefix={'@'}
             onBlur={onQueryChange}
-            value={query.read}
-            placeholder={DEFAULT_QUERY.read}
+            value={query.tree}
+            placeholder={DEFAULT_QUERY.tree}
           />
         </InlineField>
       );
+    case "defs":
+    case "libs":
+    case "filetypes": {
+      const defsType = query.type as 'defs' | 'libs' | 'filetypes';
+      return filterInput(query[defsType], DEFAULT_QUERY[defsType], "A filter for the records. Leave empty for all records");
+    }
   }
   return <p>Select a query type</p>;
 }
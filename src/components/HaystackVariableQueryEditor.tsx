@@ -80,6 +80,7 @@ export const HaystackVariableQueryEditor = ({ onChange, query }: Props) => {
         onChange={onTypeChange}
       />
       <HaystackQueryInput
+        datasource={null}
         query={query}
         onChange={onQueryChange}
       />
@@ -1,14 +1,40 @@
-import React, {  } from 'react';
-import { Stack } from '@grafana/ui';
+import React, { ChangeEvent, useEffect, useState } from 'react';
+import { AutoSizeInput, Icon, InlineField, InlineSwitch, RadioButtonGroup, Stack } from '@grafana/ui';
 import { QueryEditorProps } from '@grafana/data';
 import { DataSource } from '../datasource';
-import { HaystackDataSourceOptions, HaystackQuery } from '../types';
+import { DEFAULT_QUERY, HaystackDataSourceOptions, HaystackQuery } from '../types';
 import { HaystackQueryTypeSelector } from './HaystackQueryTypeSelector';
 import { HaystackQueryInput } from './HaystackQueryInput';
 
 type Props = QueryEditorProps<DataSource, HaystackQuery, HaystackDataSourceOptions>;
 
+const annotationsSources = [
+  { label: 'Read', value: 'read', apiRequirements: ['read'], description: 'Filter for alarm records' },
+  { label: 'Eval', value: 'eval', apiRequirements: ['eval'], description: 'Axon expression that returns alarm records' },
+  { label: 'Sparks', value: 'sparks', apiRequirements: ['eval'], description: 'Filter for SkySpark spark targets' },
+];
+
+const mixedColumnsOptions = [
+  { label: 'String', value: 'string', description: 'Convert every value to a string' },
+  { label: 'Split', value: 'split', description: 'Split into a field for each type, like curVal_num and curVal_str' },
+  { label: 'Dominant', value: 'dominant', description: 'Use the most common type, and replace other values with null' },
+];
+
+// The query types whose results are converted directly from Haystack grids
+const gridQueryTypes = ['eval', 'hisRead', 'hisReadFilter', 'read', 'nav'];
+
 export function QueryEditor({ datasource, query, onChange, onRunQuery }: Props) {
+  // The ops supported by the server, used to offer only the annotations sources it supports. Null until loaded.
+  const [ops, setOps] = useState<string[] | null>(null);
+  useEffect(() => {
+    if (query.type === "annotations" && ops === null) {
+      datasource.loadOpNames(query.refId).then(setOps);
+    }
+  }, [datasource, query.type, query.refId, ops]);
+  const availableAnnotationsSources = annotationsSources.filter((source) => {
+    return ops === null || source.apiRequirements.every((op) => ops.includes(op));
+  });
+
   const onTypeChange = (newType: string) => {
     onChange({ ...query, type: newType });
   };
@@ -21,8 +47,41 @@ export function QueryEditor({ datasource, query, onChange, onRunQuery }: Props)
       onChange({ ...query, hisReadFilter: newQuery });
     } else if (query.type === "read") {
       onChange({ ...query, read: newQuery });
+    } else if (query.type === "annotations") {
+      onChange({ ...query, annotations: newQuery });
+    } else if (query.type === "sites") {
+      onChange({ ...query, sites: newQuery });
+    } else if (query.type === "tree") {
+      onChange({ ...query, tree: newQuery });
+    } else if (query.type === "defs") {
+      onChange({ ...query, defs: newQuery });
+    } else if (query.type === "libs") {
+      onChange({ ...query, libs: newQuery });
+    } else if (query.type === "filetypes") {
+      onChange({ ...query, filetypes: newQuery });
     }
   };
+  const onAnnotationsSourceChange = (newSource: string) => {
+    onChange({ ...query, annotationsSource: newSource });
+  };
+  const onSitesStatusChange = (event: ChangeEvent<HTMLInputElement>) => {
+    onChange({ ...query, sitesStatus: event.target.value });
+  };
+  const onTreeFilterChange = (event: ChangeEvent<HTMLInputElement>) => {
+    onChange({ ...query, treeFilter: event.target.value });
+  };
+  const onHisLocalTimeChange = (event: ChangeEvent<HTMLInputElement>) => {
+    onChange({ ...query, hisLocalTime: event.target.checked });
+  };
+  const onHisNullBadStatusChange = (event: ChangeEvent<HTMLInputElement>) => {
+    onChange({ ...query, hisNullBadStatus: event.target.checked });
+  };
+  const onMixedColumnsChange = (newMixedColumns: string) => {
+    onChange({ ...query, mixedColumns: newMixedColumns });
+  };
+  const onQualityChange = (event: ChangeEvent<HTMLInputElement>) => {
+    onChange({ ...query, quality: event.target.checked });
+  };
 
   return (
     <Stack
@@ -35,10 +94,69 @@ export function QueryEditor({ datasource, query, onChange, onRunQuery }: Props)
         refId={query.refId}
         onChange={onTypeChange}
       />
+      {query.type === "annotations" && (
+        <InlineField label="Source">
+          <RadioButtonGroup
+            options={availableAnnotationsSources}
+            value={query.annotationsSource ?? DEFAULT_QUERY.annotationsSource}
+            onChange={onAnnotationsSourceChange}
+          />
+        </InlineField>
+      )}
       <HaystackQueryInput
+        datasource={datasource}
         query={query}
         onChange={onQueryChange}
       />
+      {(query.type === "hisRead" || query.type === "hisReadFilter") && (
+        <InlineField
+          label="Local time"
+          tooltip="Show timestamps in each point's local wall-clock time, for comparing sites in different timezones. Use a UTC dashboard timezone."
+        >
+          <InlineSwitch value={query.hisLocalTime || false} onChange={onHisLocalTimeChange} />
+        </InlineField>
+      )}
+      {(query.type === "hisRead" || query.type === "hisReadFilter") && (
+        <InlineField label="Hide bad data" tooltip="Null out values whose status is fault or stale">
+          <InlineSwitch value={query.hisNullBadStatus || false} onChange={onHisNullBadStatusChange} />
+        </InlineField>
+      )}
+      {gridQueryTypes.includes(query.type ?? '') && (
+        <InlineField label="Mixed types" tooltip="How columns that mix value types, like curVal across points, are converted">
+          <RadioButtonGroup
+            options={mixedColumnsOptions}
+            value={query.mixedColumns ?? 'string'}
+            onChange={onMixedColumnsChange}
+          />
+        </InlineField>
+      )}
+      {gridQueryTypes.includes(query.type ?? '') && (
+        <InlineField label="Quality" tooltip="Add a <column>_quality field of ok, na, or remove for columns with NA or Remove values">
+          <InlineSwitch value={query.quality || false} onChange={onQualityChange} />
+        </InlineField>
+      )}
+      {query.type === "sites" && (
+        <InlineField label="Status" tooltip="Filter for records that count towards each site's status using siteRef">
+          <AutoSizeInput
+            minWidth={50}
+            prefix={<Icon name="filter" />}
+            onBlur={onSitesStatusChange}
+            value={query.sitesStatus}
+            placeholder={DEFAULT_QUERY.sitesStatus}
+          />
+        </InlineField>
+      )}
+      {query.type === "tree" && (
+        <InlineField label="Filter" tooltip="Only include the records matching this filter, along with their ancestors">
+          <AutoSizeInput
+            minWidth={50}
+            prefix={<Icon name="filter" />}
+            onBlur={onTreeFilterChange}
+            value={query.treeFilter}
+            placeholder={DEFAULT_QUERY.treeFilter}
+          />
+        </InlineField>
+      )}
     </Stack>
   );
 }
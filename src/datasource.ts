@@ -8,7 +8,14 @@ import {
 } from '@grafana/data';
 import { DataSourceWithBackend, getTemplateSrv } from '@grafana/runtime';
 
-import { HaystackQuery, OpsQuery, HaystackDataSourceOptions, QueryType } from './types';
+import {
+  ActionRequest,
+  HaystackQuery,
+  OpsQuery,
+  HaystackDataSourceOptions,
+  QueryType,
+  TagSuggestion,
+} from './types';
 import { firstValueFrom } from 'rxjs';
 import { HaystackVariableSupport } from 'HaystackVariableSupport';
 
@@ -22,16 +29,66 @@ export const queryTypes: QueryType[] = [
     description: 'Read the history of points found using a filter',
   },
   { label: 'Read', value: 'read', apiRequirements: ['read'], description: 'Read the records matched by a filter' },
+  {
+    label: 'Annotations',
+    value: 'annotations',
+    apiRequirements: ['read'],
+    description: 'Read alarm or spark records as annotations. The Eval and Sparks sources also require `eval`',
+  },
+  {
+    label: 'Sites',
+    value: 'sites',
+    apiRequirements: ['read'],
+    description: 'Read site locations for a Geomap panel',
+  },
+  {
+    label: 'Tree',
+    value: 'tree',
+    apiRequirements: ['read'],
+    description: 'Read the site, space, equip, and point hierarchy',
+  },
+  { label: 'Defs', value: 'defs', apiRequirements: ['defs'], description: 'Read the defs of the Haystack 4 ontology' },
+  { label: 'Libs', value: 'libs', apiRequirements: ['libs'], description: 'Read the libs of the Haystack 4 ontology' },
+  {
+    label: 'Filetypes',
+    value: 'filetypes',
+    apiRequirements: ['filetypes'],
+    description: 'Read the filetypes supported by the server',
+  },
 ];
 
+// How long the server's tags are cached. The tag picker filters them as the user types.
+const tagsCacheTTL = 5 * 60 * 1000;
+
 export class DataSource extends DataSourceWithBackend<HaystackQuery, HaystackDataSourceOptions> {
+  private tags?: { loaded: Promise<TagSuggestion[]>; loadedAt: number };
+
   constructor(instanceSettings: DataSourceInstanceSettings<HaystackDataSourceOptions>) {
     super(instanceSettings);
     this.variables = new HaystackVariableSupport(this);
+    // Use the standard query editor for annotations
+    this.annotations = {};
   }
 
   // Queries the available ops from the datasource and returns the queryTypes that are supported.
   async loadOps(refId: string): Promise<QueryType[]> {
+    let ops = await this.loadOpNames(refId);
+
+    let availableQueryTypes = queryTypes.filter((queryType) => {
+      return queryType.apiRequirements.every((apiRequirement) => {
+        return (
+          ops.find((op) => {
+            return op === apiRequirement;
+          }) !== undefined
+        );
+      });
+    });
+
+    return availableQueryTypes;
+  }
+
+  // Queries the available ops from the datasource and returns their names, like `read` and `eval`.
+  async loadOpNames(refId: string): Promise<string[]> {
     let opsRequest = this.opsRequest(refId);
     let stream = this.query(opsRequest);
     let result = await firstValueFrom(stream);
@@ -65,17 +122,33 @@ export class DataSource extends DataSourceWithBackend<HaystackQuery, HaystackDat
       }
     }
 
-    let availableQueryTypes = queryTypes.filter((queryType) => {
-      return queryType.apiRequirements.every((apiRequirement) => {
-        return (
-          ops.find((op) => {
-            return op === apiRequirement;
-          }) !== undefined
-        );
+    return ops;
+  }
+
+  // Returns the tags defined by the server whose names contain the search, for autocompletion of filters. The tags
+  // are cached for tagsCacheTTL. Servers without defs have no tags.
+  async loadTags(search = ''): Promise<TagSuggestion[]> {
+    if (this.tags === undefined || Date.now() - this.tags.loadedAt > tagsCacheTTL) {
+      const loaded = this.getResource<TagSuggestion[]>('tags').catch(() => {
+        // Failures aren't cached, so that the tags are requested again
+        this.tags = undefined;
+        return [];
       });
-    });
+      this.tags = { loaded, loadedAt: Date.now() };
+    }
+    const tags = await this.tags.loaded;
+    const lowerSearch = search.trim().toLowerCase();
+    return tags.filter((tag) => tag.name.toLowerCase().includes(lowerSearch));
+  }
 
-    return availableQueryTypes;
+  // Returns the Hayson-encoded `actions` grid of the record. Requires actions to be enabled for the user.
+  async loadActions(id: string): Promise<unknown> {
+    return this.getResource('actions', { id });
+  }
+
+  // Invokes an action on a record and returns the Hayson-encoded result grid. Requires actions to be enabled for the user.
+  async invokeAction(request: ActionRequest): Promise<unknown> {
+    return this.postResource('actions', request);
   }
 
   applyTemplateVariables(query: HaystackQuery, scopedVars: ScopedVars): HaystackQuery {
@@ -85,6 +158,14 @@ export class DataSource extends DataSourceWithBackend<HaystackQuery, HaystackDat
       hisRead: getTemplateSrv().replace(query.hisRead, scopedVars, 'csv'),
       hisReadFilter: getTemplateSrv().replace(query.hisReadFilter, scopedVars, 'csv'),
       read: getTemplateSrv().replace(query.read, scopedVars, 'csv'),
+      annotations: getTemplateSrv().replace(query.annotations, scopedVars, 'csv'),
+      sites: getTemplateSrv().replace(query.sites, scopedVars, 'csv'),
+      sitesStatus: getTemplateSrv().replace(query.sitesStatus, scopedVars, 'csv'),
+      tree: getTemplateSrv().replace(query.tree, scopedVars, 'csv'),
+      treeFilter: getTemplateSrv().replace(query.treeFilter, scopedVars, 'csv'),
+      defs: getTemplateSrv().replace(query.defs, scopedVars, 'csv'),
+      libs: getTemplateSrv().replace(query.libs, scopedVars, 'csv'),
+      filetypes: getTemplateSrv().replace(query.filetypes, scopedVars, 'csv'),
     };
   }
 
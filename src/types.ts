@@ -7,6 +7,19 @@ export interface HaystackQuery extends DataQuery {
   hisRead?: string;
   hisReadFilter?: string;
   read?: string;
+  annotations?: string;
+  annotationsSource?: string; // 'read', 'eval', or 'sparks'
+  sites?: string;
+  sitesStatus?: string;
+  tree?: string; // The id of the root record, or empty for the full tree
+  treeFilter?: string; // A filter applied to the tree records, or empty for all records
+  hisLocalTime?: boolean; // Shift history timestamps to the point's local wall-clock time
+  mixedColumns?: string; // How columns with mixed value types are converted: 'string', 'split', or 'dominant'
+  quality?: boolean; // Add a quality field for columns with NA or Remove values
+  hisNullBadStatus?: boolean; // Null out history values whose status is fault or stale
+  defs?: string; // A filter for the defs, or empty for all defs
+  libs?: string; // A filter for the libs, or empty for all libs
+  filetypes?: string; // A filter for the filetypes, or empty for all filetypes
 }
 
 // OpsQuery is a query that is used to get the available ops from the datasource.
@@ -16,6 +29,9 @@ export class OpsQuery implements HaystackQuery {
   hisRead = '';
   hisReadFilter = '';
   read = '';
+  annotations = '';
+  sites = '';
+  tree = '';
 
   refId: string;
 
@@ -24,6 +40,12 @@ export class OpsQuery implements HaystackQuery {
   }
 }
 
+// TagSuggestion is a tag defined by the server, returned by the `tags` resource for autocompletion
+export interface TagSuggestion {
+  name: string;
+  doc?: string;
+}
+
 export interface QueryType extends SelectableValue<string> {
   apiRequirements: string[];
 }
@@ -41,6 +63,15 @@ export const DEFAULT_QUERY: Partial<HaystackQuery> = {
   hisRead: 'abcdef-123456',
   hisReadFilter: 'point and his and temp and air and outside',
   read: 'equip and ahu',
+  annotations: 'alarm',
+  annotationsSource: 'read',
+  sites: 'site',
+  sitesStatus: 'alarm and active',
+  tree: 'abcdef-123456',
+  treeFilter: 'point and equipRef->ahu',
+  defs: 'lib==^lib:phIoT',
+  libs: '',
+  filetypes: '',
 };
 
 /**
@@ -48,13 +79,45 @@ export const DEFAULT_QUERY: Partial<HaystackQuery> = {
  */
 export interface HaystackDataSourceOptions extends DataSourceJsonData {
   url: string;
+  urls?: string[];
   username: string;
   skipTlsVerify?: boolean;
+  authMode?: 'basic' | 'bearer' | 'apiKey';
+  apiKeyHeader?: string;
+  tokenUrl?: string;
+  clientId?: string;
+  tokenScope?: string;
+  tlsAuth?: boolean;
+  tlsAuthWithCACert?: boolean;
+  serverName?: string;
+  oauthPassThru?: boolean;
+  userHeader?: string;
+  enableSecureSocksProxy?: boolean;
+  rateLimit?: number;
+  rateLimitBurst?: number;
+  maxConcurrentRequests?: number;
+  enableActions?: boolean;
+  actionsRole?: ActionsRole;
+}
+
+export type ActionsRole = 'Viewer' | 'Editor' | 'Admin';
+
+// ActionRequest invokes an action on a record using the `actions` resource
+export interface ActionRequest {
+  id: string;
+  action: string;
+  args?: Record<string, string>; // Zinc-encoded argument values, by name
 }
 
 /**
  * Value that is used in the backend, but never sent over HTTP to the frontend
  */
 export interface HaystackSecureJsonData {
-  password: string;
+  password?: string;
+  bearerToken?: string;
+  apiKey?: string;
+  clientSecret?: string;
+  tlsCACert?: string;
+  tlsClientCert?: string;
+  tlsClientKey?: string;
 }